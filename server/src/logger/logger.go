@@ -0,0 +1,159 @@
+package logger
+
+//
+// Leveled, structured logging shared by the paxos library and the
+// pad server.
+//
+// Every line is written in logfmt, e.g.
+//
+//   ts=2015-05-08T10:00:00.000Z level=info replica=0 pad=001 seq=12 op=4711 msg="applied"
+//
+// Fields attached with With() are repeated on every line, so grepping
+// for an op id across the logs of all replicas traces that op from
+// socket receipt through its paxos decision to its broadcast.
+//
+// l := logger.New(os.Stderr, logger.Info).With("replica", 0)
+// l.Info("applied", "pad", padId, "seq", seq)
+//
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+type Level int32
+
+const (
+  Debug Level = iota
+  Info
+  Warn
+  Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (lv Level) String() string {
+  if lv < Debug || lv > Error {
+    return "unknown"
+  }
+  return levelNames[lv]
+}
+
+func ParseLevel(s string) (Level, error) {
+  for i, name := range levelNames {
+    if name == strings.ToLower(s) {
+      return Level(i), nil
+    }
+  }
+  return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// output is shared by a logger and all loggers derived from it.
+type output struct {
+  mu    sync.Mutex
+  w     io.Writer
+  level Level
+}
+
+type Logger struct {
+  out    *output
+  fields []interface{} // alternating keys and values
+}
+
+func New(w io.Writer, level Level) *Logger {
+  l := &Logger{}
+  l.out = &output{}
+  l.out.w = w
+  l.out.level = level
+  return l
+}
+
+// Default logs to standard error at level Info.
+func Default() *Logger {
+  return New(os.Stderr, Info)
+}
+
+// Discard drops everything.
+func Discard() *Logger {
+  return New(ioutil.Discard, Error+1)
+}
+
+// Logger::With():
+// Returns a logger that adds the given key-value pairs to every line.
+// The new logger shares its output and level with l.
+func (l *Logger) With(kv ...interface{}) *Logger {
+  nl := &Logger{}
+  nl.out = l.out
+  nl.fields = make([]interface{}, 0, len(l.fields)+len(kv))
+  nl.fields = append(nl.fields, l.fields...)
+  nl.fields = append(nl.fields, kv...)
+  return nl
+}
+
+func (l *Logger) SetLevel(level Level) {
+  l.out.mu.Lock()
+  l.out.level = level
+  l.out.mu.Unlock()
+}
+
+func (l *Logger) Enabled(level Level) bool {
+  l.out.mu.Lock()
+  defer l.out.mu.Unlock()
+  return level >= l.out.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(Info, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(Warn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+  if !l.Enabled(level) {
+    return
+  }
+
+  var b bytes.Buffer
+  b.WriteString("ts=")
+  b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+  b.WriteString(" level=")
+  b.WriteString(level.String())
+  writeFields(&b, l.fields)
+  writeFields(&b, kv)
+  b.WriteString(" msg=")
+  writeValue(&b, msg)
+  b.WriteByte('\n')
+
+  l.out.mu.Lock()
+  l.out.w.Write(b.Bytes())
+  l.out.mu.Unlock()
+}
+
+func writeFields(b *bytes.Buffer, kv []interface{}) {
+  for i := 0; i < len(kv); i += 2 {
+    b.WriteByte(' ')
+    b.WriteString(fmt.Sprint(kv[i]))
+    b.WriteByte('=')
+    if i+1 < len(kv) {
+      writeValue(b, kv[i+1])
+    } else {
+      b.WriteString("MISSING")
+    }
+  }
+}
+
+func writeValue(b *bytes.Buffer, v interface{}) {
+  if err, ok := v.(error); ok {
+    v = err.Error()
+  }
+  s := fmt.Sprint(v)
+  if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+    s = fmt.Sprintf("%q", s)
+  }
+  b.WriteString(s)
+}
@@ -0,0 +1,42 @@
+package logger
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestFormat(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, Info).With("replica", 1)
+	l.With("pad", "001").Info("applied op", "seq", 12, "text", "a b")
+
+	line := b.String()
+	for _, want := range []string{
+		" level=info ", " replica=1 pad=001 seq=12 ", ` text="a b" `,
+		` msg="applied op"` + "\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("%q does not contain %q", line, want)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, Warn)
+	child := l.With("replica", 0)
+
+	child.Info("dropped")
+	child.Warn("kept")
+	l.SetLevel(Debug)
+	child.Debug("kept too")
+
+	if n := strings.Count(b.String(), "\n"); n != 2 {
+		t.Fatalf("expected 2 lines, got %v: %q", n, b.String())
+	}
+	if strings.Contains(b.String(), "dropped") {
+		t.Fatalf("line below level written: %q", b.String())
+	}
+	if _, err := ParseLevel("bogus"); err == nil {
+		t.Fatalf("ParseLevel accepted bogus level")
+	}
+}
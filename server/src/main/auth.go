@@ -0,0 +1,117 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Per-pad roles, ordered by privilege. A user with a given role may do
+// everything a user with a lower role may do.
+const (
+  RoleNone   = iota
+  RoleViewer // may open a pad and receive broadcasts
+  RoleEditor // may additionally submit ops
+  RoleOwner  // may additionally change other users' roles
+)
+
+var roleNames = []string{"none", "viewer", "editor", "owner"}
+
+func roleName(role int) string {
+  if role < 0 || role >= len(roleNames) {
+    return "unknown"
+  }
+  return roleNames[role]
+}
+
+func parseRole(s string) (int, bool) {
+  for role, name := range roleNames {
+    if name == s {
+      return role, true
+    }
+  }
+  return RoleNone, false
+}
+
+// Authenticator is consulted once per socket.io connection. It
+// inspects the handshake request and returns the id of the user the
+// connection belongs to, or an error if the connection should not be
+// allowed to open any pad.
+type Authenticator interface {
+  Authenticate(r *http.Request) (string, error)
+}
+
+// TokenAuthenticator verifies tokens signed with a secret shared among
+// all replicas, so no replica needs to contact anybody to check them.
+// A token has the form <user>.<expiry>.<signature>, where expiry is a
+// unix timestamp and signature is the hex HMAC-SHA256 of the first two
+// parts. Clients pass the token as the "token" query parameter of the
+// socket.io handshake or as an "Authorization: Bearer" header.
+type TokenAuthenticator struct {
+  secret []byte
+}
+
+func NewTokenAuthenticator(secret []byte) *TokenAuthenticator {
+  ta := &TokenAuthenticator{}
+  ta.secret = secret
+  return ta
+}
+
+func (ta *TokenAuthenticator) sign(payload string) string {
+  mac := hmac.New(sha256.New, ta.secret)
+  mac.Write([]byte(payload))
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TokenAuthenticator::MintToken():
+// Returns a token for user that expires after ttl.
+func (ta *TokenAuthenticator) MintToken(user string, ttl time.Duration) string {
+  payload := fmt.Sprintf("%v.%v", user, time.Now().Add(ttl).Unix())
+  return payload + "." + ta.sign(payload)
+}
+
+// TokenAuthenticator::Verify():
+// Checks the signature and expiry of token, and returns the user it
+// was minted for.
+func (ta *TokenAuthenticator) Verify(token string) (string, error) {
+  sigAt := strings.LastIndex(token, ".")
+  if sigAt < 0 {
+    return "", errors.New("malformed token")
+  }
+  payload, sig := token[:sigAt], token[sigAt+1:]
+  expAt := strings.LastIndex(payload, ".")
+  if expAt <= 0 {
+    return "", errors.New("malformed token")
+  }
+  if !hmac.Equal([]byte(sig), []byte(ta.sign(payload))) {
+    return "", errors.New("bad token signature")
+  }
+  exp, err := strconv.ParseInt(payload[expAt+1:], 10, 64)
+  if err != nil {
+    return "", errors.New("malformed token")
+  }
+  if time.Now().Unix() > exp {
+    return "", errors.New("token expired")
+  }
+  return payload[:expAt], nil
+}
+
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+  token := r.URL.Query().Get("token")
+  if token == "" {
+    h := r.Header.Get("Authorization")
+    if strings.HasPrefix(h, "Bearer ") {
+      token = strings.TrimPrefix(h, "Bearer ")
+    }
+  }
+  if token == "" {
+    return "", errors.New("missing token")
+  }
+  return ta.Verify(token)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestVerifyToken(t *testing.T) {
+  fmt.Printf("Test: Token verification ...\n")
+
+  ta := NewTokenAuthenticator([]byte("secret"))
+  good := ta.MintToken("alice", time.Hour)
+  bad := good[:len(good)-1] + "0"
+  if bad == good {
+    bad = good[:len(good)-1] + "1"
+  }
+  cases := []struct {
+    name  string
+    token string
+    user  string
+    err   string
+  }{
+    {"good", good, "alice", ""},
+    {"dotted user", ta.MintToken("a.b", time.Hour), "a.b", ""},
+    {"bad signature", bad, "", "bad token signature"},
+    {"expired", ta.MintToken("alice", -time.Minute), "", "token expired"},
+    {"wrong secret",
+     NewTokenAuthenticator([]byte("other")).MintToken("alice", time.Hour),
+     "", "bad token signature"},
+    {"no dots", "alice", "", "malformed token"},
+    {"no expiry", "alice." + ta.sign("alice"), "", "malformed token"},
+    {"bad expiry", "alice.soon." + ta.sign("alice.soon"), "",
+     "malformed token"},
+    {"empty", "", "", "malformed token"},
+  }
+  for _, c := range cases {
+    user, err := ta.Verify(c.token)
+    if c.err == "" && (err != nil || user != c.user) {
+      t.Fatalf("%v: got %q, %v; want %q", c.name, user, err, c.user)
+    }
+    if c.err != "" && (err == nil || err.Error() != c.err) {
+      t.Fatalf("%v: got %q, %v; want %v", c.name, user, err, c.err)
+    }
+  }
+
+  // from the query or the Authorization header
+  r, _ := http.NewRequest("GET", "/socket.io/?token="+good, nil)
+  if user, err := ta.Authenticate(r); err != nil || user != "alice" {
+    t.Fatalf("query token: got %q, %v", user, err)
+  }
+  r, _ = http.NewRequest("GET", "/ws", nil)
+  if _, err := ta.Authenticate(r); err == nil {
+    t.Fatalf("no token authenticated")
+  }
+  r.Header.Set("Authorization", "Bearer "+good)
+  if user, err := ta.Authenticate(r); err != nil || user != "alice" {
+    t.Fatalf("header token: got %q, %v", user, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// The first user to open a pad owns it, and only owners change roles.
+func TestPadRoles(t *testing.T) {
+  fmt.Printf("Test: Pad ownership and roles ...\n")
+
+  ta := NewTokenAuthenticator([]byte("secret"))
+  esa := makeReplicasWith("roles", 3, ServerConfig{Auth: ta})
+  defer cleanup(esa)
+  connect := func(es *EPServer, user string) (*clientConn, *fakeTransport) {
+    r, _ := http.NewRequest("GET", "/ws", nil)
+    r.Header.Set("Authorization", "Bearer "+ta.MintToken(user, time.Hour))
+    tr := &fakeTransport{es: es, id: "ws-" + user + fmt.Sprint(nrand()),
+                         req: r}
+    return newClientConn(es, tr, ProtoTyped), tr
+  }
+  // expect fails unless tr was sent exactly one message since, of
+  // event and holding what.
+  expect := func(tr *fakeTransport, event string, what string) {
+    got := tr.take()
+    if len(got) != 1 || !strings.HasPrefix(got[0], event+" ") ||
+       !strings.Contains(got[0], what) {
+      t.Fatalf("got %v, want %v %v", got, event, what)
+    }
+  }
+
+  alice, ta1 := connect(esa[0], "alice")
+  alice.handle("open pad", `{"PadId": "p"}`)
+  expect(ta1, "init_comt_op", `"PadId":"p"`)
+  catchUp(t, esa)
+  for _, es := range esa {
+    if role := es.getPadById("p").roleOf("alice"); role != RoleOwner {
+      t.Fatalf("replica %v: the first opener holds %v", es.me,
+               roleName(role))
+    }
+  }
+
+  // others hold no role on a claimed pad, on any replica
+  bob, tb := connect(esa[1], "bob")
+  bob.handle("open pad", `{"PadId": "p"}`)
+  expect(tb, "error", ErrAccessDenied)
+
+  alice.handle("set role", `{"User": "bob", "Role": "viewer"}`)
+  catchUp(t, esa)
+  bob.handle("open pad", `{"PadId": "p"}`)
+  expect(tb, "init_comt_op", `"PadId":"p"`)
+  bob.handle("op", `{"Ref": 3, "Op": {"ID": 2, "Version": 0, ` +
+                   `"Type": "Insert", "Position": 0, "Value": "b"}}`)
+  expect(tb, "error", ErrReadOnly)
+  bob.handle("set role", `{"User": "carol", "Role": "owner"}`)
+  expect(tb, "error", ErrAccessDenied)
+  // owners may not demote themselves
+  alice.handle("set role", `{"User": "alice", "Role": "none"}`)
+  expect(ta1, "error", ErrInvalid)
+  alice.handle("set role", `{"User": "bob", "Role": "root"}`)
+  expect(ta1, "error", ErrInvalid)
+
+  alice.handle("set role", `{"User": "bob", "Role": "editor"}`)
+  catchUp(t, esa)
+  bob.handle("op", `{"Ref": 4, "Op": {"ID": 2, "Version": 0, ` +
+                   `"Type": "Insert", "Position": 0, "Value": "b"}}`)
+  if got := tb.take(); len(got) != 2 || !strings.HasPrefix(got[1], "ack ") {
+    t.Fatalf("editor's op: got %v", got)
+  }
+
+  // tokens that do not verify open nothing
+  r, _ := http.NewRequest("GET", "/ws?token=mallory.1.00", nil)
+  tm := &fakeTransport{es: esa[0], id: "ws-mallory", req: r}
+  newClientConn(esa[0], tm, ProtoTyped).handle("open pad", `{"PadId": "q"}`)
+  expect(tm, "error", ErrUnauthorized)
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,17 @@
+package main
+
+// Broadcaster is how a replica publishes what it commits to the
+// clients of each pad, whatever transport they use. applyEntry()
+// calls it with the replica's lock held, so it must not block.
+type Broadcaster interface {
+  Broadcast(padId string, event string, arg string)
+}
+
+// broadcasters publishes to each of its members in turn.
+type broadcasters []Broadcaster
+
+func (bs broadcasters) Broadcast(padId string, event string, arg string) {
+  for _, b := range bs {
+    b.Broadcast(padId, event, arg)
+  }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "reflect"
+  "sync"
+  "testing"
+)
+
+// recorder is a Broadcaster that keeps what it is sent, by pad.
+type recorder struct {
+  mu   sync.Mutex
+  pads map[string][]string // pad id -> "event arg"
+}
+
+func (r *recorder) Broadcast(padId string, event string, arg string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if r.pads == nil {
+    r.pads = make(map[string][]string)
+  }
+  r.pads[padId] = append(r.pads[padId], event+" "+arg)
+}
+
+// ops returns the ops broadcast to pad padId, failing on anything else.
+func (r *recorder) ops(t *testing.T, padId string) []Op {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  var ret []Op
+  for _, msg := range r.pads[padId] {
+    var sOp SOp
+    const prefix = "op "
+    if len(msg) < len(prefix) || msg[:len(prefix)] != prefix ||
+       json.Unmarshal([]byte(msg[len(prefix):]), &sOp) != nil {
+      t.Fatalf("pad %v: unexpected broadcast %q", padId, msg)
+    }
+    op := Op{ID: sOp.ID, Version: sOp.Version, Position: sOp.Position,
+             Value: sOp.Value}
+    if sOp.Type != "NoOp" {
+      op.Type, _ = parseOpType(sOp.Type)
+    }
+    ret = append(ret, op)
+  }
+  return ret
+}
+
+func TestBroadcasts(t *testing.T) {
+  fmt.Printf("Test: Every replica broadcasts the same ops ...\n")
+
+  esa, recs := makeRecordedReplicas("bcast", 3, 4)
+  defer cleanup(esa)
+
+  // clients on every replica type concurrently, each at the
+  // revision its replica has reached
+  const nops = 10
+  var wg sync.WaitGroup
+  for i, es := range esa {
+    wg.Add(1)
+    go func(client int64, es *EPServer) {
+      defer wg.Done()
+      for k := 0; k < nops; k++ {
+        pm := es.getPadById("pad")
+        op := Op{ID: client, Version: pm.revision(), Type: InsertOp,
+                 Position: 0, Value: fmt.Sprintf("%v", client)}
+        es.processOp("pad", op)
+      }
+    }(int64(i), es)
+  }
+  wg.Wait()
+  catchUp(t, esa)
+  checkSame(t, esa)
+
+  want := recs[0].ops(t, "pad")
+  if len(want) != nops*len(esa) {
+    t.Fatalf("replica 0 broadcast %v ops, want %v", len(want), nops*len(esa))
+  }
+  text := ""
+  for v, op := range want {
+    if op.Version != uint64(v) {
+      t.Fatalf("op %v broadcast at revision %v", v, op.Version)
+    }
+    var ok bool
+    if text, ok = applyOp(text, op); !ok {
+      t.Fatalf("broadcast %v does not apply to %q", opString(op), text)
+    }
+  }
+  if pm := esa[0].getPadById("pad"); text != pm.getText() {
+    t.Fatalf("broadcasts yield %q but the pad is %q", text, pm.getText())
+  }
+  for i, rec := range recs[1:] {
+    if got := rec.ops(t, "pad"); !reflect.DeepEqual(got, want) {
+      t.Fatalf("replica %v broadcast %v, replica 0 %v", i+1, got, want)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-  "log"
   "os"
+  "logger"
+  "unicode/utf16"
 )
 
 const (
@@ -11,6 +12,11 @@ const (
   DeleteOp
 )
 
+// Positions count UTF-16 code units, as JavaScript strings do, so the
+// browser can use them as string indices. A delete removes one code
+// point, which is two code units for characters outside the Basic
+// Multilingual Plane such as most emoji; once committed, its Value is
+// the code point it removed.
 type Op struct {
   ID       int64
   Version  uint64
@@ -19,9 +25,26 @@ type Op struct {
   Value    string
 }
 
+// Op::length():
+// Returns the number of code units op inserts or deletes. A delete
+// counts as the first code point of its Value, whatever else a client
+// put there, or as one unit if its Value is not known yet.
+func (op Op) length() uint64 {
+  if op.Type == DeleteOp {
+    for _, r := range op.Value {
+      return uint64(utf16.RuneLen(r))
+    }
+    return 1
+  }
+  return uint64(len(utf16.Encode([]rune(op.Value))))
+}
+
+// where assert() reports; main() sets it to the server's logger
+var assertLog = logger.Default()
+
 func assert(condition bool, callSite string) {
   if !condition {
-    log.Printf("Assertion failed in %s, abort.\n", callSite)
+    assertLog.Error("assertion failed, abort", "at", callSite)
     os.Exit(1)
   }
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+  "logger"
+  "paxos"
+  "time"
+)
+
+// ServerConfig holds the settings shared by all replicas spawned by
+// this process.
+type ServerConfig struct {
+  Auth   Authenticator // nil disables authentication
+  Limits Limits
+  Logger *logger.Logger
+
+  // how long a paxos message may go unanswered before it counts as
+  // lost; zero keeps paxos.DefaultTimeout
+  RPCTimeout time.Duration
+
+  // makes the transport of each replica's paxos peer; nil means
+  // paxos.NewPooledRPCTransport
+  Transport func() paxos.Transport
+
+  // how many log entries a replica may be appending at once; zero
+  // means DEFAULT_PIPELINE
+  Pipeline int
+
+  // how many revisions of each pad's history are kept for late ops
+  // and resuming clients; zero means DEFAULT_HISTORY. All replicas
+  // must agree on it, as it decides which ops are too late.
+  History int
+}
+
+const DEFAULT_PIPELINE = 8
+const DEFAULT_HISTORY = 10000
@@ -0,0 +1,330 @@
+package main
+
+import (
+  "net/http"
+  "sync/atomic"
+  "encoding/json"
+  "logger"
+)
+
+// Transport is a client connection as the pad protocol sees it,
+// whatever carries it: socket.io, or the plain WebSocket endpoint.
+type Transport interface {
+  Id() string             // unique among this replica's connections
+  Request() *http.Request // the request that opened the connection
+  Emit(event string, arg string)
+  Join(padId string)      // receive the "op" broadcasts of pad padId
+}
+
+// The messages a client may send, see protocol.go.
+var clientEvents = []string{"hello", "open pad", "op", "op batch",
+                            "set role", "share link"}
+
+// clientConn handles the pad protocol for one client connection.
+type clientConn struct {
+  es      *EPServer
+  t       Transport
+  lg      *logger.Logger
+  user    string
+  authErr error // the connection cannot open any pad if set
+  proto   int32 // protocol version spoken, see protocol.go
+}
+
+// newClientConn()
+// Starts handling connection t, which speaks protocol version proto
+// until it says hello. Authenticates once per connection. A connection
+// that fails to authenticate stays open but cannot open any pad.
+func newClientConn(es *EPServer, t Transport, proto int) *clientConn {
+  c := &clientConn{es: es, t: t, proto: int32(proto)}
+  c.lg = es.log.With("socket", t.Id())
+  if es.auth != nil {
+    c.user, c.authErr = es.auth.Authenticate(t.Request())
+    if c.authErr != nil {
+      c.lg.Info("authentication failed", "err", c.authErr)
+    } else {
+      c.lg = c.lg.With("user", c.user)
+    }
+  }
+  return c
+}
+
+func (c *clientConn) typed() bool {
+  return atomic.LoadInt32(&c.proto) >= ProtoTyped
+}
+
+func (c *clientConn) fail(code string, msg string, ref uint64) {
+  if c.typed() {
+    emitJSON(c.t, "error", ErrorMsg{code, msg, ref})
+  } else {
+    c.t.Emit("error", msg)
+  }
+}
+
+// clientConn::handle()
+// Handles one message of the client.
+func (c *clientConn) handle(event string, arg string) {
+  switch event {
+  case "hello":
+    c.hello(arg)
+  case "open pad":
+    c.openPad(arg)
+  case "op":
+    c.op(arg)
+  case "op batch":
+    c.opBatch(arg)
+  case "set role":
+    c.setRole(arg)
+  case "share link":
+    c.shareLink(arg)
+  default:
+    c.fail(ErrInvalid, "unknown message "+event, 0)
+  }
+}
+
+// clientConn::close()
+// Forgets the connection once it is gone.
+func (c *clientConn) close() {
+  c.es.socketCheckOut(c.t.Id())
+}
+
+func (c *clientConn) isOpen() bool {
+  _, ok := c.es.lookupSession(c.t.Id())
+  return ok
+}
+
+// A "hello" message picks the protocol version, and must come
+// before "open pad".
+func (c *clientConn) hello(arg string) {
+  if c.isOpen() {
+    c.fail(ErrAlreadyOpen, "already opened", 0)
+    return
+  }
+  var hello HelloMsg
+  err := decodeStrict(arg, &hello)
+  var reply HelloReply
+  if err == nil {
+    reply, err = negotiate(hello)
+  }
+  if err != nil {
+    // answer in the newest version, which the client asked about
+    atomic.StoreInt32(&c.proto, ProtoLatest)
+    c.fail(errorCode(err, ErrInvalid), err.Error(), 0)
+    return
+  }
+  atomic.StoreInt32(&c.proto, int32(reply.Version))
+  c.lg.Debug("hello", "proto", reply.Version)
+  emitJSON(c.t, "hello", reply)
+}
+
+// Client should first send a "open pad" message, with "pad id"
+// (an integer in string format) as the argument
+// all subsequent edits are assumed to be operating on this pad.
+// The pad id may also be a read-only alias obtained through a
+// "share link" message, in which case all edits are refused.
+// A client that reconnects may instead pass the revision it has
+// seen and the ops it queued meanwhile (see parseOpenPad()); its
+// queued ops are committed for it, and it is then sent only the
+// ops committed since, its queued ones among them.
+func (c *clientConn) openPad(arg string) {
+  es := c.es
+  if c.authErr != nil {
+    c.fail(ErrUnauthorized, "unauthorized: "+c.authErr.Error(), 0)
+    return
+  }
+  if c.isOpen() {
+    c.fail(ErrAlreadyOpen, "already opened", 0)
+    return
+  }
+  req, err := decodeOpenPad(c.typed(), arg)
+  if err != nil {
+    c.lg.Info("invalid open pad", "err", err)
+    c.fail(errorCode(err, ErrInvalid), "invalid request: "+err.Error(), 0)
+    return
+  }
+  id := req.PadId
+  pad, readOnly, err := es.admit(id, c.user, true, len(req.Pending) > 0)
+  if err != nil {
+    c.lg.Info("open pad refused", "pad", id, "err", err)
+    c.fail(errorCode(err, ErrAccessDenied), err.Error(), 0)
+    return
+  }
+  // opened to be edited, so the pad is created here
+  es.getPadById(pad)
+  pm, err := es.awaitRevision(pad, req.Since)
+  if err != nil {
+    c.fail(errorCode(err, ErrUnknownRevision), err.Error(), 0)
+    return
+  }
+
+  es.socketCheckIn(c.t.Id(), pad, c.user, readOnly)
+
+  // the queued ops are committed before the client is sent the pad,
+  // so that the ops it sends next are at later revisions than those
+  // it sent before losing its connection (see resumeOps())
+  code := ErrInvalid
+  if len(req.Pending) > 0 {
+    ss, _ := es.lookupSession(c.t.Id())
+    if err = es.checkBatchLimits(ss, req.Pending); err != nil {
+      c.lg.Info("batch refused", "pad", pad, "err", err)
+      code = ErrLimit
+    } else if err = es.resumeOps(pad, req.Since, req.Pending); err != nil {
+      c.lg.Info("resume failed", "pad", pad, "err", err)
+      code = errorCode(err, ErrInvalid)
+    }
+  }
+
+  // wrapping mutex around it because socketio not thread-safe
+  // this is cumbersome and should be fixed later
+  es.mu.Lock()
+  c.t.Join(pad)
+  es.mu.Unlock()
+  c.lg.Debug("pad opened", "pad", pad, "readonly", readOnly,
+             "since", req.Since)
+  pi := pm.getInfoSince(req.Since)
+  if readOnly {
+    // do not leak the editable id
+    pi.PadId = id
+  }
+  emitJSON(c.t, "init_comt_op", pi)
+  if err != nil {
+    c.fail(code, err.Error(), 0)
+  }
+}
+
+// An "op" message's argument is a JSON string with all string
+// fields, or an OpMsg under ProtoTyped. Field names should be
+// kept consistent with Op{} in common.go, case-sensitive.
+func (c *clientConn) op(arg string) {
+  es := c.es
+  ss, ok := es.lookupSession(c.t.Id())
+  if !ok {
+    c.fail(ErrNotOpen, "not checked in", 0)
+    return
+  }
+  op, ref, err := decodeOp(c.typed(), arg)
+  if err != nil {
+    c.lg.Info("invalid op", "pad", ss.PadId, "err", err)
+    c.fail(errorCode(err, ErrInvalid), "invalid op: "+err.Error(), ref)
+    return
+  }
+  // viewers keep receiving broadcasts but may not edit
+  if ss.ReadOnly || !es.authorize(ss.PadId, ss.User, RoleEditor) {
+    c.fail(ErrReadOnly, "read-only access", ref)
+    return
+  }
+  if err := es.getPadById(ss.PadId).checkVersion(op.Version); err != nil {
+    c.fail(errorCode(err, ErrInvalid), err.Error(), ref)
+    return
+  }
+  // refuse ops over a limit before they enter the paxos log
+  if err := es.checkLimits(ss, op); err != nil {
+    c.lg.Info("op refused", "pad", ss.PadId, "err", err)
+    c.fail(ErrLimit, err.Error(), ref)
+    return
+  }
+  // the op itself reaches clients through the broadcast of
+  // committed ops; only acknowledge it here
+  cop := es.processOp(ss.PadId, op)
+  if c.typed() {
+    emitJSON(c.t, "ack", AckMsg{ref, toStringOps([]Op{cop})})
+  }
+}
+
+// An "op batch" message's argument is a JSON array of ops in the
+// same form as "op" messages, or a BatchMsg under ProtoTyped. A
+// client sends it for ops it queued while it could not send them.
+// They must all have the same ID and Version, and each applies on
+// top of the ones before it. They are committed together, through
+// one paxos log entry.
+func (c *clientConn) opBatch(arg string) {
+  es := c.es
+  ss, ok := es.lookupSession(c.t.Id())
+  if !ok {
+    c.fail(ErrNotOpen, "not checked in", 0)
+    return
+  }
+  ops, ref, err := decodeBatch(c.typed(), arg)
+  if err != nil {
+    c.lg.Info("invalid batch", "pad", ss.PadId, "err", err)
+    c.fail(errorCode(err, ErrInvalid), "invalid batch: "+err.Error(), ref)
+    return
+  }
+  if ss.ReadOnly || !es.authorize(ss.PadId, ss.User, RoleEditor) {
+    c.fail(ErrReadOnly, "read-only access", ref)
+    return
+  }
+  if err := es.getPadById(ss.PadId).checkVersion(ops[0].Version); err != nil {
+    c.fail(errorCode(err, ErrInvalid), err.Error(), ref)
+    return
+  }
+  if err := es.checkBatchLimits(ss, ops); err != nil {
+    c.lg.Info("batch refused", "pad", ss.PadId, "err", err)
+    c.fail(ErrLimit, err.Error(), ref)
+    return
+  }
+  cops := es.processBatch(ss.PadId, ops)
+  if c.typed() {
+    emitJSON(c.t, "ack", AckMsg{ref, toStringOps(cops)})
+  }
+}
+
+// A "set role" message's argument is a JSON string of the form
+// {"User": "<user id>", "Role": "none|viewer|editor|owner"}.
+// Only owners of the pad may change roles, and not their own.
+func (c *clientConn) setRole(arg string) {
+  es := c.es
+  ss, ok := es.lookupSession(c.t.Id())
+  if !ok {
+    c.fail(ErrNotOpen, "not checked in", 0)
+    return
+  }
+  if es.auth == nil {
+    c.fail(ErrAuthDisabled, "authentication disabled", 0)
+    return
+  }
+  if !es.authorize(ss.PadId, ss.User, RoleOwner) {
+    c.fail(ErrAccessDenied, "access denied", 0)
+    return
+  }
+  var req RoleMsg
+  var err error
+  if c.typed() {
+    err = decodeStrict(arg, &req)
+  } else {
+    err = json.Unmarshal([]byte(arg), &req)
+  }
+  if err != nil {
+    c.fail(ErrInvalid, "invalid request", 0)
+    return
+  }
+  role, ok := parseRole(req.Role)
+  if !ok || req.User == "" || req.User == ss.User {
+    c.fail(ErrInvalid, "invalid request", 0)
+    return
+  }
+  es.setRole(ss.PadId, req.User, role)
+}
+
+// A "share link" message has no meaningful argument. The server
+// replies with a "share link" message carrying the read-only alias
+// of the pad this socket has opened, as a ShareLinkMsg under
+// ProtoTyped.
+func (c *clientConn) shareLink(arg string) {
+  es := c.es
+  ss, ok := es.lookupSession(c.t.Id())
+  if !ok {
+    c.fail(ErrNotOpen, "not checked in", 0)
+    return
+  }
+  // an alias bypasses the ACL, so only owners may hand it out
+  if ss.ReadOnly || !es.authorize(ss.PadId, ss.User, RoleOwner) {
+    c.fail(ErrAccessDenied, "access denied", 0)
+    return
+  }
+  alias := es.shareLink(ss.PadId)
+  if c.typed() {
+    emitJSON(c.t, "share link", ShareLinkMsg{alias})
+  } else {
+    c.t.Emit("share link", alias)
+  }
+}
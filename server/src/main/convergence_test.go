@@ -0,0 +1,349 @@
+package main
+
+import (
+  "fmt"
+  "math/rand"
+  "sync"
+  "testing"
+  "time"
+)
+
+// charRef names one character ever inserted into a pad: the n-th op
+// committed for client.
+type charRef struct {
+  client int64
+  n      int
+}
+
+// simClient drives a pad the way the browser client in
+// socket_editting/public does, but may have up to inflight ops
+// outstanding. It learns committed ops in order from its replica, as
+// the "op" broadcasts would tell it, and checks that each of its own
+// ops was committed with the effect the user intended.
+type simClient struct {
+  t        *testing.T
+  id       int64
+  es       *EPServer
+  padId    string
+  rng      *rand.Rand
+  inflight int
+
+  text     string    // committed text, as observed
+  refs     []charRef // the character behind every byte of text
+  version  uint64    // number of committed ops observed
+  nacked   int       // number of own ops committed
+
+  pending  []Op      // outstanding ops, oldest first, each applying
+                     // on top of the text and the ones before it
+  intents  []intent  // what each pending op was meant to do
+  outbox   chan Op   // ops to send, in order, like a socket
+  sending  sync.WaitGroup
+  failed   bool
+}
+
+// An insert was typed between left and right; a delete was meant to
+// remove left. Either may be nil at the ends of the text.
+type intent struct {
+  left  *charRef
+  right *charRef
+}
+
+// simClient::fail():
+// Reports an error from a client's goroutine, where t.Fatalf is not
+// allowed, and stops the client.
+func (c *simClient) fail(format string, args ...interface{}) {
+  c.t.Errorf(format, args...)
+  c.failed = true
+}
+
+func refAt(refs []charRef, i int) *charRef {
+  if i < 0 || i >= len(refs) {
+    return nil
+  }
+  r := refs[i]
+  return &r
+}
+
+func indexOf(refs []charRef, r *charRef) int {
+  if r == nil {
+    return -1
+  }
+  for i := range refs {
+    if refs[i] == *r {
+      return i
+    }
+  }
+  return -1
+}
+
+// simClient::view():
+// Returns what the user sees: the committed text with the pending ops
+// applied.
+func (c *simClient) view() (string, []charRef) {
+  text := c.text
+  refs := append([]charRef{}, c.refs...)
+  for i, op := range c.pending {
+    pos := int(op.Position)
+    switch op.Type {
+    case InsertOp:
+      r := charRef{c.id, c.nacked + i}
+      text = text[:pos] + op.Value + text[pos:]
+      refs = append(refs[:pos], append([]charRef{r}, refs[pos:]...)...)
+    case DeleteOp:
+      text = text[:pos] + text[pos+1:]
+      refs = append(refs[:pos], refs[pos+1:]...)
+    }
+  }
+  return text, refs
+}
+
+// simClient::edit():
+// Types or deletes a random character and sends it to the replica.
+func (c *simClient) edit() {
+  text, refs := c.view()
+  op := Op{ID: c.id, Version: c.version, Type: InsertOp}
+  var in intent
+  if len(text) > 0 && c.rng.Intn(5) < 2 {
+    op.Type = DeleteOp
+    op.Position = uint64(c.rng.Intn(len(text)))
+    op.Value = text[op.Position : op.Position+1]
+    in.left = refAt(refs, int(op.Position))
+  } else {
+    op.Position = uint64(c.rng.Intn(len(text) + 1))
+    op.Value = string('a' + byte(c.id%26))
+    in.left = refAt(refs, int(op.Position)-1)
+    in.right = refAt(refs, int(op.Position))
+  }
+  c.pending = append(c.pending, op)
+  c.intents = append(c.intents, in)
+  c.sending.Add(1)
+  c.outbox <- op
+}
+
+// simClient::send():
+// Sends ops one at a time, as the socket handler processes them.
+func (c *simClient) send() {
+  for op := range c.outbox {
+    c.es.processOp(c.padId, op)
+    c.sending.Done()
+  }
+}
+
+// simClient::observe():
+// Applies the ops its replica committed since it last looked.
+func (c *simClient) observe() {
+  if c.failed {
+    return
+  }
+  for _, cop := range c.es.committedOps(c.padId, c.version) {
+    if cop.ID == c.id {
+      if len(c.pending) == 0 {
+        c.fail("client %v: unexpected own op %+v", c.id, cop)
+        return
+      }
+      c.checkIntention(cop)
+      c.pending = c.pending[1:]
+      c.intents = c.intents[1:]
+      if c.failed {
+        return
+      }
+    } else {
+      // the server will transform the pending ops the same way
+      c.pending, _ = opTransformPast(c.pending, cop)
+    }
+    c.apply(cop)
+  }
+}
+
+// simClient::checkIntention():
+// cop is the committed form of c.pending[0].
+func (c *simClient) checkIntention(cop Op) {
+  sent, in := c.pending[0], c.intents[0]
+  if cop.Type != sent.Type || cop.Position != sent.Position ||
+     cop.Value != sent.Value {
+    c.fail("client %v: expected %+v, server committed %+v",
+           c.id, sent, cop)
+  }
+  pos := int(cop.Position)
+  switch cop.Type {
+  case InsertOp:
+    if l := indexOf(c.refs, in.left); l >= pos {
+      c.fail("client %v: %+v lands at %v, left of %v at %v",
+             c.id, cop, pos, *in.left, l)
+    }
+    if r := indexOf(c.refs, in.right); r >= 0 && r < pos {
+      c.fail("client %v: %+v lands at %v, right of %v at %v",
+             c.id, cop, pos, *in.right, r)
+    }
+  case DeleteOp:
+    if target := indexOf(c.refs, in.left); target != pos {
+      c.fail("client %v: %+v deletes at %v instead of %v at %v",
+             c.id, cop, pos, *in.left, target)
+    }
+  case NoOp:
+    // only a delete whose target is already gone may vanish
+    if indexOf(c.refs, in.left) >= 0 {
+      c.fail("client %v: %+v dropped, but %v still exists",
+             c.id, sent, *in.left)
+    }
+  }
+}
+
+func (c *simClient) apply(cop Op) {
+  pos := int(cop.Position)
+  switch cop.Type {
+  case InsertOp:
+    var r charRef
+    if cop.ID == c.id {
+      r = charRef{c.id, c.nacked}
+    } else {
+      r = c.peerRef(cop)
+    }
+    c.text = c.text[:pos] + cop.Value + c.text[pos:]
+    c.refs = append(c.refs[:pos], append([]charRef{r}, c.refs[pos:]...)...)
+  case DeleteOp:
+    c.text = c.text[:pos] + c.text[pos+1:]
+    c.refs = append(c.refs[:pos], c.refs[pos+1:]...)
+  }
+  if cop.ID == c.id {
+    c.nacked++
+  }
+  c.version++
+}
+
+// simClient::peerRef():
+// Names a character inserted by another client. Every client sees the
+// same committed ops, so counting them per client yields the same
+// names everywhere.
+func (c *simClient) peerRef(cop Op) charRef {
+  n := 0
+  for _, prev := range c.es.committedOps(c.padId, 0)[:c.version] {
+    if prev.ID == cop.ID {
+      n++
+    }
+  }
+  return charRef{cop.ID, n}
+}
+
+// EPServer::committedOps():
+// Returns the ops committed to padId from revision since on.
+func (es *EPServer) committedOps(padId string, since uint64) []Op {
+  es.mu.Lock()
+  pm, ok := es.pads[padId]
+  es.mu.Unlock()
+  if !ok {
+    return nil
+  }
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  var ops []Op
+  for v := since; v < pm.rev; v++ {
+    ops = append(ops, pm.history[v])
+  }
+  return ops
+}
+
+// runClients has nedits ops made by each of nclients clients per
+// replica, all on one pad, each client with up to inflight ops
+// outstanding, and checks that clients and replicas end up with the
+// same text.
+func runClients(t *testing.T, esa []*EPServer, nclients int, nedits int,
+                inflight int, seed int64) {
+  const padId = "conv"
+
+  // replicas learn of ops proposed elsewhere only by applying the log
+  stop := make(chan bool)
+  var appliers sync.WaitGroup
+  for _, es := range esa {
+    appliers.Add(1)
+    go func(es *EPServer) {
+      defer appliers.Done()
+      for {
+        select {
+        case <-stop:
+          return
+        case <-time.After(5 * time.Millisecond):
+          es.autoApply()
+        }
+      }
+    }(es)
+  }
+
+  var clients []*simClient
+  for _, es := range esa {
+    for i := 0; i < nclients; i++ {
+      c := &simClient{t: t, es: es, padId: padId, inflight: inflight}
+      c.id = int64(len(clients) + 1)
+      c.rng = rand.New(rand.NewSource(seed + c.id))
+      c.outbox = make(chan Op, nedits)
+      clients = append(clients, c)
+    }
+  }
+
+  var wg sync.WaitGroup
+  for _, c := range clients {
+    wg.Add(1)
+    go func(c *simClient) {
+      defer wg.Done()
+      go c.send()
+      for n := 0; n < nedits && !c.failed; {
+        c.observe()
+        if len(c.pending) < c.inflight && !c.failed {
+          c.edit()
+          n++
+        }
+        time.Sleep(time.Duration(c.rng.Intn(3)) * time.Millisecond)
+      }
+      close(c.outbox)
+      // processOp returns once the op is applied on c's replica
+      c.sending.Wait()
+      c.observe()
+    }(c)
+  }
+  wg.Wait()
+  close(stop)
+  appliers.Wait()
+  if t.Failed() {
+    t.FailNow()
+  }
+
+  catchUp(t, esa)
+  nops := checkSame(t, esa)
+  if nops != len(clients)*nedits {
+    t.Fatalf("%v ops committed, want %v", nops, len(clients)*nedits)
+  }
+  text := esa[0].pads[padId].getText()
+  for _, c := range clients {
+    c.observe()
+    if c.text != text {
+      t.Fatalf("client %v sees %q, replicas have %q", c.id, c.text, text)
+    }
+  }
+}
+
+func TestConvergence(t *testing.T) {
+  esa := makeReplicas(t, "conv", 3, 4)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Clients on every replica converge ...\n")
+  runClients(t, esa, 3, 30, 1, 1)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestConvergenceOneReplica(t *testing.T) {
+  esa := makeReplicas(t, "convone", 3, 4)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Clients on one replica converge ...\n")
+  runClients(t, esa[:1], 6, 30, 1, 2)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestConvergenceFastTyping(t *testing.T) {
+  esa := makeReplicas(t, "convfast", 3, 4)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Clients with many ops in flight converge ...\n")
+  runClients(t, esa, 3, 40, 8, 3)
+  fmt.Printf("  ... Passed\n")
+}
@@ -1,23 +1,60 @@
 package main
 
 import (
+  "fmt"
   "sync"
+  "sort"
+  "strings"
   "crypto/rand"
   "paxos"
+  "logger"
   "math/big"
   "encoding/gob"
-  "github.com/googollee/go-socket.io"
 )
 
+// Session is what the server knows about a socket that has opened a
+// pad. It is live, per-replica information and not paxos-agreed.
+type Session struct {
+  PadId    string
+  User     string
+  ReadOnly bool // opened through a read-only alias
+  limiter  *rateLimiter // nil if ops are not rate limited
+}
+
+// Read-only aliases all start with this prefix, and no pad may have
+// an id starting with it.
+const ALIAS_PREFIX = "ro-"
+
 type EPServer struct {
   mu          sync.Mutex
-  sio         *socketio.Server
+  bcast       Broadcaster           // where committed ops are published
+  hub         *hub                  // pad rooms of WebSocket and HTTP
+                                   // clients
   px          *paxos.Paxos
-  skts        map[string]string     // socket id -> pad id
+  me          int                   // index of this replica
+  metrics     *Metrics
+  log         *logger.Logger
+  auth        Authenticator         // nil if authentication is disabled
+  limits      Limits
+  history     int                   // revisions of history kept per pad
+  skts        map[string]*Session   // socket id -> session
                                    // live session information
+  posters     map[string]*rateLimiter // HTTP client -> its rate limiter
   pads        map[string]*PadManager // pad id -> the actual etherpad
                                    // manager, paxos-agreed state
+  aliases     map[string]string     // read-only alias -> pad id
+                                   // paxos-agreed state
   commitPoint int
+
+  seqMu       sync.Mutex            // protects nextSeq and inflight,
+                                   // never held during a paxos wait
+  nextSeq     int                   // lowest instance not yet reserved
+                                   // by a local proposal
+  inflight    map[int]bool          // instances local proposals are
+                                   // still waiting on
+  window      chan bool             // one token per proposal in flight
+  results     map[int64][]Op        // entry id -> committed ops, for
+                                   // local proposals awaiting them
 }
 
 func nrand() int64 {
@@ -33,55 +70,336 @@ func (es *EPServer) getPadById(padId string) *PadManager {
 
   pm, ok := es.pads[padId]
   if !ok {
-    pm = NewPadManager(padId)
+    pm = NewPadManager(padId, es.history)
     es.pads[padId] = pm
+    es.metrics.setPadsLoaded(len(es.pads))
   }
   
   return pm
 }
 
-func (es *EPServer) socketCheckIn(sktId string, padId string) {
+// EPServer::readPad():
+// Returns pad padId for reading. Unlike getPadById(), does not create
+// the pad: one that nobody has written to reads as empty.
+func (es *EPServer) readPad(padId string) *PadManager {
+  es.mu.Lock()
+  defer es.mu.Unlock()
+
+  if pm, ok := es.pads[padId]; ok {
+    return pm
+  }
+  return NewPadManager(padId, es.history)
+}
+
+func (es *EPServer) socketCheckIn(sktId string, padId string, user string,
+                                  readOnly bool) {
   es.mu.Lock()
   defer es.mu.Unlock()
-  es.skts[sktId] = padId
+  ss := &Session{padId, user, readOnly, nil}
+  if es.limits.OpRate > 0 {
+    ss.limiter = newRateLimiter(es.limits.OpRate, es.limits.OpBurst)
+  }
+  es.skts[sktId] = ss
+  es.metrics.setOpenSockets(len(es.skts))
 }
 
 func (es *EPServer) socketCheckOut(sktId string) {
   es.mu.Lock()
   defer es.mu.Unlock()
   delete(es.skts, sktId)
+  es.metrics.setOpenSockets(len(es.skts))
 }
 
-func (es *EPServer) lookupPadId(sktId string) (string, bool) {
+func (es *EPServer) lookupSession(sktId string) (*Session, bool) {
   es.mu.Lock()
   defer es.mu.Unlock()
-  pid, ok := es.skts[sktId]
-  return pid, ok
+  ss, ok := es.skts[sktId]
+  return ss, ok
+}
+
+// EPServer::authorize():
+// Reports whether user holds at least role on pad padId. Everybody
+// holds every role when authentication is disabled.
+func (es *EPServer) authorize(padId string, user string, role int) bool {
+  if es.auth == nil {
+    return true
+  }
+  return es.readPad(padId).roleOf(user) >= role
+}
+
+// EPServer::claimPad():
+// Makes user the owner of pad padId if nobody owns it yet. Pads are
+// only claimed when authentication is enabled.
+func (es *EPServer) claimPad(padId string, user string) {
+  if es.auth == nil || es.readPad(padId).isClaimed() {
+    return
+  }
+  es.proposeEntry(PxLogEntry{Kind: ClaimPadEntry, PadId: padId, User: user})
+}
+
+func (es *EPServer) setRole(padId string, user string, role int) {
+  es.proposeEntry(PxLogEntry{Kind: SetRoleEntry, PadId: padId,
+                             User: user, Role: role})
+}
+
+// EPServer::resolvePadId():
+// Maps an id given by a client to the pad it refers to. Read-only
+// aliases resolve to the pad they were minted for. ok is false for
+// alias-like ids that were never minted.
+func (es *EPServer) resolvePadId(id string) (padId string, readOnly bool,
+                                             ok bool) {
+  if !strings.HasPrefix(id, ALIAS_PREFIX) {
+    return id, false, true
+  }
+  es.mu.Lock()
+  defer es.mu.Unlock()
+  padId, ok = es.aliases[id]
+  return padId, true, ok
+}
+
+// EPServer::admit():
+// Resolves the pad id a client opens and checks that user may view
+// the pad, and edit it if edit is set. If claim is set, as when a
+// client opens a pad to edit it, the first user to do so owns the
+// pad; reads claim nothing. An alias itself grants read access.
+func (es *EPServer) admit(id string, user string, claim bool,
+                          edit bool) (padId string, readOnly bool,
+                                      err error) {
+  padId, readOnly, ok := es.resolvePadId(id)
+  if !ok {
+    return "", false, protoErrorf(ErrUnknownLink, "unknown share link")
+  }
+  if !readOnly {
+    if claim {
+      es.claimPad(padId, user)
+    }
+    if !es.authorize(padId, user, RoleViewer) {
+      return padId, false, protoErrorf(ErrAccessDenied, "access denied")
+    }
+  }
+  if edit && (readOnly || !es.authorize(padId, user, RoleEditor)) {
+    return padId, readOnly, protoErrorf(ErrReadOnly, "read-only access")
+  }
+  return padId, readOnly, nil
+}
+
+// EPServer::awaitRevision():
+// Returns pad padId, as readPad() does, once it has reached revision
+// rev, which a client may have seen on another replica, catching up
+// with the log first if needed.
+func (es *EPServer) awaitRevision(padId string,
+                                  rev uint64) (*PadManager, error) {
+  pm := es.readPad(padId)
+  if rev > pm.revision() {
+    es.autoApply()
+    pm = es.readPad(padId)
+    if rev > pm.revision() {
+      return nil, protoErrorf(ErrUnknownRevision, "unknown revision")
+    }
+  }
+  return pm, nil
+}
+
+// EPServer::deletePad():
+// Deletes pad padId on every replica, through paxos.
+func (es *EPServer) deletePad(padId string, user string) {
+  es.proposeEntry(PxLogEntry{Kind: DeletePadEntry, PadId: padId,
+                             User: user})
 }
 
-func (es *EPServer) processOp(padId string, op Op) {
+// EPServer::listPads():
+// Returns the pads this replica holds that user may view, by id.
+func (es *EPServer) listPads(user string) []PadSummary {
+  es.mu.Lock()
+  pms := make([]*PadManager, 0, len(es.pads))
+  for _, pm := range es.pads {
+    pms = append(pms, pm)
+  }
+  es.mu.Unlock()
+
+  ret := []PadSummary{}
+  for _, pm := range pms {
+    if es.authorize(pm.padId, user, RoleViewer) {
+      ret = append(ret, PadSummary{pm.padId, pm.revision(), pm.size()})
+    }
+  }
+  sort.Slice(ret, func(i, j int) bool { return ret[i].PadId < ret[j].PadId })
+  return ret
+}
+
+// EPServer::shareLink():
+// Returns the read-only alias of pad padId, minting one through paxos
+// if the pad does not have one yet.
+func (es *EPServer) shareLink(padId string) string {
+  pm := es.getPadById(padId)
+  if alias := pm.getAlias(); alias != "" {
+    return alias
+  }
+  alias := fmt.Sprintf("%v%016x", ALIAS_PREFIX, nrand())
+  es.proposeEntry(PxLogEntry{Kind: MintAliasEntry, PadId: padId,
+                             Alias: alias})
+  // somebody else may have minted an alias concurrently; theirs wins
+  return pm.getAlias()
+}
+
+// EPServer::processOp():
+// Commits a client op to pad padId, and returns it as committed. The
+// entry id doubles as the op id in the logs of every replica.
+func (es *EPServer) processOp(padId string, op Op) Op {
+  le := PxLogEntry{Kind: ClientOpEntry, PadId: padId, ClientOp: op}
+  le.EntryId = newEntryId()
+  es.log.Debug("received op", "pad", padId, "op", le.EntryId,
+               "client", op.ID, "version", op.Version)
+  return es.proposeClientEntry(le)[0]
+}
+
+// EPServer::resumeOps():
+// Commits the ops a client queued while it was disconnected, each
+// applying on top of revision since and the ones before it, as one
+// batch. The first of them may be committed through the lost
+// connection before the batch, in which case they are skipped, or
+// after it, in which case they are dropped then; either way the
+// client finds them among the ops committed after since. Telling them
+// from ops the client sends later relies on those being at later
+// revisions, so the client must not be sent the pad before this
+// returns.
+func (es *EPServer) resumeOps(padId string, since uint64, pending []Op) error {
+  if len(pending) == 0 {
+    return nil
+  }
+  pm := es.getPadById(padId)
+  id := pending[0].ID
+  for _, op := range pending {
+    if op.ID != id || op.Version != since {
+      return protoErrorf(ErrInvalid, "pending ops must all be by one " +
+                         "client, at revision %v", since)
+    }
+  }
+  pm.mu.Lock()
+  base := pm.base
+  pm.mu.Unlock()
+  if since < base {
+    return protoErrorf(ErrCompacted, "revision %v is no longer kept; " +
+                       "pending ops dropped", since)
+  }
+  le := PxLogEntry{Kind: ResumeEntry, PadId: padId, Batch: pending}
+  le.EntryId = newEntryId()
+  cops := es.proposeClientEntry(le)
+  es.log.Info("resumed", "pad", padId, "client", id, "since", since,
+              "pending", len(pending), "skipped", len(pending)-len(cops))
+  return nil
+}
+
+// EPServer::processBatch():
+// Commits ops by one client, all at the same Version and each applying
+// on top of the ones before it, through a single log entry, so that
+// they are committed together and at consecutive revisions.
+func (es *EPServer) processBatch(padId string, ops []Op) []Op {
+  le := PxLogEntry{Kind: ClientBatchEntry, PadId: padId, Batch: ops}
+  le.EntryId = newEntryId()
+  es.log.Debug("received batch", "pad", padId, "op", le.EntryId,
+               "client", ops[0].ID, "version", ops[0].Version,
+               "len", len(ops))
+  return es.proposeClientEntry(le)
+}
+
+// EPServer::proposeClientEntry():
+// Like proposeEntry(), for an entry of client ops, and returns the ops
+// as committed.
+func (es *EPServer) proposeClientEntry(le PxLogEntry) []Op {
+  es.mu.Lock()
+  es.results[le.EntryId] = nil
+  es.mu.Unlock()
+
+  es.proposeEntry(le)
+
   es.mu.Lock()
   defer es.mu.Unlock()
+  cops := es.results[le.EntryId]
+  delete(es.results, le.EntryId)
+  return cops
+}
 
+func newEntryId() int64 {
   newId := int64(0)
   for newId == 0 {
     newId = nrand()
   }
-  le := PxLogEntry{newId, padId, op}
-  es.paxosLogConsolidate()
+  return newId
+}
+
+// EPServer::proposeEntry():
+// Appends le to the paxos log, under a fresh entry id unless it
+// already has one, and applies the log up to and including it.
+//
+// Up to cap(es.window) entries are appended concurrently, each at its
+// own instance, and es.mu is only taken to apply them. Entries are
+// still applied strictly in log order: whichever caller finds the log
+// decided up to its entry applies every entry before it as well.
+func (es *EPServer) proposeEntry(le PxLogEntry) {
+  if le.EntryId == 0 {
+    le.EntryId = newEntryId()
+  }
+  es.window <- true
   seq := es.paxosAppendToLog(le)
-  es.applyLog(seq)
+  <-es.window
+  es.log.Debug("appended", "pad", le.PadId, "op", le.EntryId, "seq", seq)
+
+  es.mu.Lock()
+  defer es.mu.Unlock()
+  if seq >= es.commitPoint {
+    es.paxosLogConsolidate_explicit(seq)
+    es.applyLog(seq)
+  }
 }
 
-func NewEPServer(pxpeers []string, me int, sio *socketio.Server) *EPServer {
+// NewEPServer()
+// Makes replica me of pxpeers. Committed ops are published to b, if
+// not nil, besides the replica's own hub.
+func NewEPServer(pxpeers []string, me int, b Broadcaster,
+                 cfg ServerConfig) *EPServer {
   gob.Register(PxLogEntry{})
 
   es := &EPServer{}
-  es.sio = sio
-  es.px = paxos.Make(pxpeers, me, nil)
-  es.skts = make(map[string]string)
+  es.hub = newHub()
+  es.bcast = es.hub
+  if b != nil {
+    es.bcast = broadcasters{b, es.hub}
+  }
+  if cfg.Logger == nil {
+    cfg.Logger = logger.Default()
+  }
+  es.log = cfg.Logger.With("replica", me)
+  var t paxos.Transport
+  if cfg.Transport != nil {
+    t = cfg.Transport()
+  } else {
+    t = paxos.NewPooledRPCTransport(cfg.RPCTimeout)
+  }
+  es.px = paxos.MakeWithLogger(pxpeers, me, t, cfg.Logger)
+  if cfg.RPCTimeout > 0 {
+    es.px.SetTimeout(cfg.RPCTimeout)
+  }
+  es.me = me
+  es.metrics = newMetrics()
+  es.auth = cfg.Auth
+  es.limits = cfg.Limits
+  es.history = cfg.History
+  if es.history <= 0 {
+    es.history = DEFAULT_HISTORY
+  }
+  es.skts = make(map[string]*Session)
+  es.posters = make(map[string]*rateLimiter)
+  es.aliases = make(map[string]string)
   es.pads = make(map[string]*PadManager)
   es.commitPoint = 0
+  es.nextSeq = 0
+  es.inflight = make(map[int]bool)
+  es.results = make(map[int64][]Op)
+  if cfg.Pipeline <= 0 {
+    cfg.Pipeline = DEFAULT_PIPELINE
+  }
+  es.window = make(chan bool, cfg.Pipeline)
 
   return es
 }
@@ -0,0 +1,589 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "reflect"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+  "logger"
+)
+
+func testPort(tag string, host int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "ep-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag + "-"
+  s += strconv.Itoa(host)
+  return s
+}
+
+// makeReplicas starts n replicas of one pad server, each allowed to
+// append pipeline entries at once.
+func makeReplicas(t *testing.T, tag string, n int, pipeline int) []*EPServer {
+  esa, _ := makeRecordedReplicas(tag, n, pipeline)
+  return esa
+}
+
+// makeRecordedReplicas is makeReplicas, also returning what each
+// replica broadcasts.
+func makeRecordedReplicas(tag string, n int,
+                          pipeline int) ([]*EPServer, []*recorder) {
+  return startReplicas(tag, n, ServerConfig{Pipeline: pipeline})
+}
+
+// makeReplicasWith is makeReplicas with the settings of cfg, such as
+// an Authenticator.
+func makeReplicasWith(tag string, n int, cfg ServerConfig) []*EPServer {
+  esa, _ := startReplicas(tag, n, cfg)
+  return esa
+}
+
+func startReplicas(tag string, n int,
+                   cfg ServerConfig) ([]*EPServer, []*recorder) {
+  peers := make([]string, n)
+  for i := 0; i < n; i++ {
+    peers[i] = testPort(tag, i)
+  }
+  cfg.Logger = logger.Discard()
+  esa := make([]*EPServer, n)
+  recs := make([]*recorder, n)
+  for i := 0; i < n; i++ {
+    recs[i] = &recorder{}
+    esa[i] = NewEPServer(peers, i, recs[i], cfg)
+  }
+  return esa, recs
+}
+
+func cleanup(esa []*EPServer) {
+  for _, es := range esa {
+    es.px.Kill()
+  }
+}
+
+func insertOp(client int64, value string) Op {
+  return Op{ID: client, Version: 0, Type: InsertOp, Position: 0,
+            Value: value}
+}
+
+// catchUp applies everything any replica has decided on every replica.
+func catchUp(t *testing.T, esa []*EPServer) {
+  max := -1
+  for _, es := range esa {
+    if m := es.px.MaxKnown(); m > max {
+      max = m
+    }
+  }
+  for _, es := range esa {
+    to := 10 * time.Millisecond
+    for iters := 0; ; iters++ {
+      es.autoApply()
+      es.mu.Lock()
+      cp := es.commitPoint
+      es.mu.Unlock()
+      if cp > max {
+        break
+      }
+      if iters > 30 {
+        t.Fatalf("replica %v stuck at %v, want %v", es.me, cp, max+1)
+      }
+      time.Sleep(to)
+      if to < time.Second {
+        to *= 2
+      }
+    }
+  }
+}
+
+// replay returns the text that the history of pm yields.
+func replay(pm *PadManager) string {
+  text := ""
+  for v := uint64(0); v < pm.rev; v++ {
+    var ok bool
+    if text, ok = applyOp(text, pm.history[v]); !ok {
+      return fmt.Sprintf("<%v does not apply>", opString(pm.history[v]))
+    }
+  }
+  return text
+}
+
+// checkSame fails unless all replicas hold the same pads, and returns
+// the total number of ops committed to them.
+func checkSame(t *testing.T, esa []*EPServer) int {
+  nops := 0
+  for id, pm := range esa[0].pads {
+    if text := replay(pm); text != pm.getText() {
+      t.Fatalf("pad %v: history yields %q but text is %q",
+               id, text, pm.getText())
+    }
+    for _, es := range esa[1:] {
+      other, ok := es.pads[id]
+      if !ok {
+        t.Fatalf("replica %v lacks pad %v", es.me, id)
+      }
+      if other.rev != pm.rev || other.getText() != pm.getText() ||
+         !reflect.DeepEqual(other.history, pm.history) {
+        t.Fatalf("pad %v differs: %q on replica 0, %q on replica %v",
+                 id, pm.getText(), other.getText(), es.me)
+      }
+    }
+    nops += int(pm.rev)
+  }
+  for _, es := range esa[1:] {
+    if len(es.pads) != len(esa[0].pads) {
+      t.Fatalf("replica %v has %v pads, replica 0 has %v",
+               es.me, len(es.pads), len(esa[0].pads))
+    }
+  }
+  return nops
+}
+
+func TestPipelinedAppend(t *testing.T) {
+  const nops = 40
+  esa := makeReplicas(t, "pipe", 3, 8)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Concurrent ops through one replica ...\n")
+
+  var wg sync.WaitGroup
+  for i := 0; i < nops; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      esa[0].processOp("pad", insertOp(int64(i), "x"))
+    }(i)
+  }
+  wg.Wait()
+
+  // every op has been applied by the time processOp returns, and a
+  // lone proposer never needs to fill a hole
+  esa[0].mu.Lock()
+  cp := esa[0].commitPoint
+  esa[0].mu.Unlock()
+  if cp != nops {
+    t.Fatalf("commit point %v, want %v", cp, nops)
+  }
+  catchUp(t, esa)
+  if n := checkSame(t, esa); n != nops {
+    t.Fatalf("%v ops committed, want %v", n, nops)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// Ops appended concurrently through one replica take one instance each,
+// even when the later instances are decided first: applying them waits
+// for the earlier ones rather than filling them with noops.
+func TestPipelinedSeqs(t *testing.T) {
+  const nops = 8
+  esa := makeReplicasWith("pipeseqs", 3, ServerConfig{Pipeline: nops})
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Concurrent ops through one replica take an instance each ...\n")
+
+  // the first instance is reserved by a proposal that is slow to start,
+  // so that every later one is decided before it
+  held := esa[0].reserveSeq()
+  le := PxLogEntry{EntryId: newEntryId(), Kind: ClientOpEntry, PadId: "pad",
+                   ClientOp: insertOp(int64(nops), "y")}
+  go func() {
+    time.Sleep(500 * time.Millisecond)
+    esa[0].startAndWait(held, le)
+    esa[0].releaseSeq(held)
+  }()
+
+  var wg sync.WaitGroup
+  for i := 0; i < nops; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      esa[0].processOp("pad", insertOp(int64(i), "x"))
+    }(i)
+  }
+  wg.Wait()
+
+  if n := esa[0].px.MaxKnown() + 1; n != nops + 1 {
+    t.Fatalf("%v ops took %v instances", nops + 1, n)
+  }
+  if _, v := esa[0].px.Status(held); v.(PxLogEntry).EntryId != le.EntryId {
+    t.Fatalf("instance %v of a local proposal was filled with %+v", held, v)
+  }
+  catchUp(t, esa)
+  if n := checkSame(t, esa); n != nops + 1 {
+    t.Fatalf("%v ops committed, want %v", n, nops + 1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPipelinedReplicas(t *testing.T) {
+  const nclients = 4
+  const nops = 10
+  esa := makeReplicas(t, "pipemany", 3, 4)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Concurrent ops through every replica ...\n")
+
+  var wg sync.WaitGroup
+  for _, es := range esa {
+    for c := 0; c < nclients; c++ {
+      wg.Add(1)
+      go func(es *EPServer, client int64) {
+        defer wg.Done()
+        pad := fmt.Sprintf("pad%v", client%2)
+        for i := 0; i < nops; i++ {
+          es.processOp(pad, insertOp(client, strconv.Itoa(es.me)))
+        }
+      }(es, int64(es.me*nclients+c))
+    }
+  }
+  wg.Wait()
+
+  catchUp(t, esa)
+  if n := checkSame(t, esa); n != len(esa)*nclients*nops {
+    t.Fatalf("%v ops committed, want %v", n, len(esa)*nclients*nops)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// A client loses its connection to one replica with "a" in flight and
+// "b" and "c" queued, and resumes through another.
+func TestResume(t *testing.T) {
+  esa := makeReplicas(t, "resume", 3, 4)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Queued ops are resumed once ...\n")
+
+  esa[0].processOp("pad", insertOp(1, "x"))
+  esa[0].processOp("pad", Op{ID: 2, Version: 1, Type: InsertOp,
+                             Position: 1, Value: "a"})
+  cop := esa[1].processOp("pad", Op{ID: 3, Version: 2, Type: InsertOp,
+                                    Position: 0, Value: "y"})
+  if cop.Version != 2 || cop.Position != 0 {
+    t.Fatalf("processOp returned %v; want v2 insert at 0", opString(cop))
+  }
+  catchUp(t, esa)
+
+  pending := []Op{
+    {ID: 2, Version: 1, Type: InsertOp, Position: 1, Value: "a"},
+    {ID: 2, Version: 1, Type: InsertOp, Position: 2, Value: "b"},
+    {ID: 2, Version: 1, Type: InsertOp, Position: 3, Value: "c"},
+  }
+  if err := esa[2].resumeOps("pad", 1, pending); err != nil {
+    t.Fatalf("resumeOps: %v", err)
+  }
+  catchUp(t, esa)
+  checkSame(t, esa)
+  if text := esa[0].pads["pad"].getText(); text != "yxabc" {
+    t.Fatalf("text %q, want \"yxabc\"", text)
+  }
+
+  // what the client gets on reopening the pad
+  pi := esa[2].pads["pad"].getInfoSince(1)
+  if pi.Snapshot || pi.Base != 1 || len(pi.Ops) != 4 || pi.Version != 5 {
+    t.Fatalf("got %+v; want the 4 ops after revision 1", pi)
+  }
+
+  bad := []Op{{ID: 2, Version: 4, Type: InsertOp, Value: "d"}}
+  if err := esa[2].resumeOps("pad", 5, bad); err == nil {
+    t.Fatalf("resumeOps took an op at another revision")
+  }
+
+  // "d" is still in flight through replica 0 when the client resumes
+  // through replica 1, and is committed again only once
+  d := Op{ID: 2, Version: 5, Type: InsertOp, Position: 0, Value: "d"}
+  if err := esa[1].resumeOps("pad", 5, []Op{d}); err != nil {
+    t.Fatalf("resumeOps: %v", err)
+  }
+  if cop := esa[0].processOp("pad", d); cop.Type != NoOp {
+    t.Fatalf("leftover op committed as %v", opString(cop))
+  }
+  esa[0].processOp("pad", Op{ID: 2, Version: 6, Type: InsertOp,
+                             Position: 1, Value: "e"})
+  catchUp(t, esa)
+  checkSame(t, esa)
+  if text := esa[0].pads["pad"].getText(); text != "deyxabc" {
+    t.Fatalf("text %q, want \"deyxabc\"", text)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// Ops sent at a revision no longer kept are refused, not committed as
+// noops, whichever way they arrive.
+func TestCompactedOps(t *testing.T) {
+  fmt.Printf("Test: Ops from before the history kept are refused ...\n")
+
+  esa := makeReplicasWith("compacted", 3, ServerConfig{History: 2})
+  defer cleanup(esa)
+  es := esa[0]
+  for i := 0; i < 4; i++ {
+    es.processOp("pad", Op{ID: 1, Version: uint64(i), Type: InsertOp,
+                           Position: uint64(i), Value: "x"})
+  }
+  if err := es.getPadById("pad").checkVersion(1); errorCode(err, "") !=
+     ErrCompacted {
+    t.Fatalf("revision 1 after compaction: %v", err)
+  }
+
+  typed := &fakeTransport{es: es, id: "ws-typed"}
+  tc := newClientConn(es, typed, ProtoTyped)
+  tc.handle("open pad", `{"PadId": "pad", "Since": 4}`)
+  legacy := &fakeTransport{es: es, id: "ws-legacy"}
+  lc := newClientConn(es, legacy, ProtoLegacy)
+  lc.handle("open pad", "pad")
+  typed.take()
+  legacy.take()
+
+  tc.handle("op", `{"Ref": 1, "Op": {"ID": 2, "Version": 1, ` +
+                  `"Type": "Insert", "Position": 0, "Value": "a"}}`)
+  tc.handle("op batch", `{"Ref": 2, "Ops": [{"ID": 2, "Version": 0, ` +
+                        `"Type": "Insert", "Position": 0, "Value": "a"}]}`)
+  got := typed.take()
+  if len(got) != 2 || !strings.Contains(got[0], ErrCompacted) ||
+     !strings.Contains(got[0], `"Ref":1`) ||
+     !strings.Contains(got[1], ErrCompacted) {
+    t.Fatalf("typed client: got %v", got)
+  }
+  lc.handle("op", `{"ID": "3", "Version": "1", "Type": "Insert", ` +
+                  `"Position": "0", "Value": "b"}`)
+  if got := legacy.take(); len(got) != 1 ||
+     !strings.HasPrefix(got[0], "error revision 1 is no longer kept") {
+    t.Fatalf("legacy client: got %v", got)
+  }
+
+  srv := httptest.NewServer(http.HandlerFunc(es.serveAPI))
+  defer srv.Close()
+  status, body := postOp(t, srv.URL + API_PREFIX + "pad/ops",
+    `{"Ops": [{"ID": 4, "Version": 1, "Type": "Insert", "Position": 0, ` +
+    `"Value": "c"}]}`)
+  if status != http.StatusGone || !strings.Contains(body, ErrCompacted) {
+    t.Fatalf("POST: got %v %v", status, body)
+  }
+
+  catchUp(t, esa)
+  pm := es.getPadById("pad")
+  if text, rev := pm.textAt(); text != "xxxx" || rev != 4 {
+    t.Fatalf("text %q at %v, want \"xxxx\" at 4", text, rev)
+  }
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestParseOpenPad(t *testing.T) {
+  fmt.Printf("Test: Parsing open pad ...\n")
+
+  req, err := parseOpenPad("001")
+  if err != nil || req.PadId != "001" || req.Since != 0 ||
+     len(req.Pending) != 0 {
+    t.Fatalf("plain pad id parsed as %+v, %v", req, err)
+  }
+  req, err = parseOpenPad(`{"PadId": "001", "Since": "7", "Pending": [` +
+    `{"ID": "5", "Version": "7", "Type": "Delete", "Position": "2", ` +
+    `"Value": "x"}]}`)
+  want := Op{ID: 5, Version: 7, Type: DeleteOp, Position: 2, Value: "x"}
+  if err != nil || req.PadId != "001" || req.Since != 7 ||
+     !reflect.DeepEqual(req.Pending, []Op{want}) {
+    t.Fatalf("resume parsed as %+v, %v", req, err)
+  }
+  for _, arg := range []string{`{"PadId": "001"}`, `{"Since": "x"}`,
+                               `{"Since": "1", "Pending": [{}]}`, `{`} {
+    if _, err := parseOpenPad(arg); err == nil {
+      t.Fatalf("%v accepted", arg)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// A batch is committed at consecutive revisions, however many ops are
+// committed concurrently through other replicas.
+func TestBatchAtomic(t *testing.T) {
+  const nops = 30
+  esa := makeReplicas(t, "batch", 3, 4)
+  defer cleanup(esa)
+
+  fmt.Printf("Test: Batches are committed together ...\n")
+
+  var batch []Op
+  for i := 0; i < nops; i++ {
+    batch = append(batch, Op{ID: 100, Type: InsertOp, Position: uint64(i),
+                             Value: "b"})
+  }
+  var wg sync.WaitGroup
+  for _, es := range esa[1:] {
+    wg.Add(1)
+    go func(es *EPServer) {
+      defer wg.Done()
+      for i := 0; i < nops; i++ {
+        es.processOp("pad", insertOp(int64(es.me), "x"))
+      }
+    }(es)
+  }
+  time.Sleep(5 * time.Millisecond)
+  esa[0].processBatch("pad", batch)
+  wg.Wait()
+
+  catchUp(t, esa)
+  if n := checkSame(t, esa); n != 3*nops {
+    t.Fatalf("%v ops committed, want %v", n, 3*nops)
+  }
+  pm := esa[0].pads["pad"]
+  var revs []uint64
+  for v := uint64(0); v < pm.rev; v++ {
+    if pm.history[v].ID == 100 {
+      revs = append(revs, v)
+    }
+  }
+  if len(revs) != nops || revs[nops-1]-revs[0] != nops-1 {
+    t.Fatalf("batch committed at revisions %v", revs)
+  }
+  text := pm.getText()
+  if !strings.Contains(text, strings.Repeat("b", nops)) {
+    t.Fatalf("batch not contiguous in %q", text)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestParseBatch(t *testing.T) {
+  fmt.Printf("Test: Parsing op batches ...\n")
+
+  op := func(id string, version string) map[string]string {
+    return map[string]string{"ID": id, "Version": version, "Type": "Insert",
+                             "Position": "0", "Value": "x"}
+  }
+  ops, err := toNativeBatch([]map[string]string{op("1", "2"), op("1", "2")})
+  if err != nil || len(ops) != 2 || ops[1].ID != 1 || ops[1].Version != 2 {
+    t.Fatalf("parsed as %+v, %v", ops, err)
+  }
+  bad := [][]map[string]string{
+    {},
+    {op("1", "2"), op("3", "2")},
+    {op("1", "2"), op("1", "3")},
+    {op("1", "x")},
+  }
+  for _, b := range bad {
+    if _, err := toNativeBatch(b); err == nil {
+      t.Fatalf("%v accepted", b)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// A read-only alias resolves to its pad on every replica, refuses
+// edits, and never tells its viewers the editable id.
+func TestShareLinks(t *testing.T) {
+  esa := makeReplicas(t, "alias", 3, 4)
+  defer cleanup(esa)
+  srv := httptest.NewServer(http.HandlerFunc(esa[2].serveAPI))
+  defer srv.Close()
+
+  fmt.Printf("Test: Read-only share links ...\n")
+
+  const pad = "editable-id"
+  owner := &fakeTransport{es: esa[0], id: "ws-owner"}
+  oc := newClientConn(esa[0], owner, ProtoTyped)
+  oc.handle("open pad", `{"PadId": "` + pad + `"}`)
+  oc.handle("share link", "")
+  got := owner.take()
+  var link ShareLinkMsg
+  if len(got) != 2 || !strings.HasPrefix(got[1], "share link ") ||
+     json.Unmarshal([]byte(strings.TrimPrefix(got[1], "share link ")),
+                    &link) != nil ||
+     !strings.HasPrefix(link.Alias, ALIAS_PREFIX) {
+    t.Fatalf("share link: got %v", got)
+  }
+  alias := link.Alias
+  if again := esa[0].shareLink(pad); again != alias {
+    t.Fatalf("second share link %v, want %v", again, alias)
+  }
+  catchUp(t, esa)
+  for _, es := range esa {
+    id, readOnly, ok := es.resolvePadId(alias)
+    if id != pad || !readOnly || !ok {
+      t.Fatalf("replica %v resolves %v to %v, %v, %v", es.me, alias, id,
+               readOnly, ok)
+    }
+    if _, _, ok := es.resolvePadId(ALIAS_PREFIX + "0123"); ok {
+      t.Fatalf("replica %v resolves an alias never minted", es.me)
+    }
+  }
+
+  viewer := &fakeTransport{es: esa[1], id: "ws-viewer"}
+  vc := newClientConn(esa[1], viewer, ProtoTyped)
+  vc.handle("open pad", `{"PadId": "` + ALIAS_PREFIX + `0123"}`)
+  if got := viewer.take(); len(got) != 1 ||
+     !strings.Contains(got[0], ErrUnknownLink) {
+    t.Fatalf("unknown alias: got %v", got)
+  }
+  // edits with the open are refused before opening anything
+  vc.handle("open pad", `{"PadId": "` + alias + `", "Pending": [` +
+            `{"ID": 2, "Version": 0, "Type": "Insert", "Value": "v"}]}`)
+  vc.handle("open pad", `{"PadId": "` + alias + `"}`)
+  vc.handle("op", `{"Ref": 1, "Op": {"ID": 2, "Version": 0, ` +
+                  `"Type": "Insert", "Position": 0, "Value": "v"}}`)
+  vc.handle("op batch", `{"Ref": 2, "Ops": [{"ID": 2, "Version": 0, ` +
+                        `"Type": "Insert", "Position": 0, "Value": "v"}]}`)
+  vc.handle("share link", "")
+  got = viewer.take()
+  want := []string{ErrReadOnly, "init_comt_op", ErrReadOnly, ErrReadOnly,
+                   ErrAccessDenied}
+  if len(got) != len(want) {
+    t.Fatalf("viewer: got %v", got)
+  }
+  for i := range want {
+    if !strings.Contains(got[i], want[i]) {
+      t.Fatalf("viewer message %v: got %v, want %v", i, got[i], want[i])
+    }
+  }
+  if !strings.Contains(got[1], `"PadId":"` + alias + `"`) {
+    t.Fatalf("viewer opened %v", got[1])
+  }
+
+  // through HTTP alike
+  status, body := postOp(t, srv.URL + API_PREFIX + alias + "/ops",
+    `{"Ops": [{"ID": 2, "Version": 0, "Type": "Insert", "Value": "v"}]}`)
+  if status != http.StatusForbidden || !strings.Contains(body, ErrReadOnly) {
+    t.Fatalf("POST through the alias: got %v %v", status, body)
+  }
+  oc.handle("op", `{"Ref": 1, "Op": {"ID": 1, "Version": 0, ` +
+                  `"Type": "Insert", "Position": 0, "Value": "o"}}`)
+  catchUp(t, esa)
+  resp, err := http.Get(srv.URL + API_PREFIX + alias + "/ops?since=0")
+  if err != nil {
+    t.Fatalf("GET through the alias: %v", err)
+  }
+  data, _ := io.ReadAll(resp.Body)
+  resp.Body.Close()
+  if !strings.Contains(string(data), `"Value":"o"`) {
+    t.Fatalf("GET through the alias: got %s", data)
+  }
+  esa[0].deletePad(pad, "")
+  catchUp(t, esa)
+
+  // everything a viewer was sent: the owner's op, and the deletion
+  sent := append(viewer.take(), string(body), string(data))
+  all := strings.Join(sent, "\n")
+  if !strings.Contains(all, `"Value":"o"`) ||
+     !strings.Contains(all, "pad deleted") {
+    t.Fatalf("viewer missed broadcasts: %v", all)
+  }
+  for _, msg := range append(got, sent...) {
+    if strings.Contains(msg, pad) {
+      t.Fatalf("viewer was sent the editable id: %v", msg)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "time"
+)
+
+// A peer counts as up if it replied within this long, and is probed
+// by /status and /healthz otherwise.
+const HEALTH_FRESHNESS = 5 * time.Second
+
+type PeerInfo struct {
+  Index       int
+  Addr        string
+  Done        int    // last Done() value heard from the peer
+  State       string // "up", "down", or "unknown" if never contacted
+  LastContact string // RFC 3339, empty if the peer never replied
+}
+
+// ReplicaStatus is the body of /status.
+type ReplicaStatus struct {
+  Replica      int
+  CommitPoint  int
+  Max          int
+  MaxKnown     int
+  Min          int
+  Peers        []PeerInfo
+  MajorityUp   bool // whether this replica can currently reach a majority
+}
+
+// EPServer::getStatus():
+// Collects the status of this replica without taking es.mu, so that it
+// answers even while a paxos round is stuck. Probing stale peers makes
+// it wait up to one paxos message timeout.
+func (es *EPServer) getStatus() ReplicaStatus {
+  st := ReplicaStatus{}
+  st.Replica = es.me
+  st.CommitPoint = es.getCommitPoint()
+  st.Max = es.px.Max()
+  st.MaxKnown = es.px.MaxKnown()
+  st.Min = es.px.Min()
+
+  // Replies older than HEALTH_FRESHNESS prove nothing, so peers not
+  // heard from since are asked again before judging them.
+  es.px.Probe(HEALTH_FRESHNESS)
+  up := 0
+  for i, ps := range es.px.PeerStatus() {
+    pi := PeerInfo{i, ps.Addr, ps.Done, "unknown", ""}
+    if ps.Reachable && time.Since(ps.LastContact) < HEALTH_FRESHNESS {
+      pi.State = "up"
+      up++
+    } else if ps.Contacted {
+      pi.State = "down"
+    }
+    if !ps.LastContact.IsZero() {
+      pi.LastContact = ps.LastContact.Format(time.RFC3339)
+    }
+    st.Peers = append(st.Peers, pi)
+  }
+  st.MajorityUp = up > len(st.Peers)/2
+  return st
+}
+
+// EPServer::serveStatus():
+// HTTP handler for /status.
+func (es *EPServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+  stJSON, err := json.MarshalIndent(es.getStatus(), "", "  ")
+  assert(err == nil, "serveStatus")
+  w.Header().Set("Content-Type", "application/json")
+  w.Write(stJSON)
+}
+
+// EPServer::serveHealthz():
+// HTTP handler for /healthz. Fails if this replica cannot reach a
+// majority, since it cannot commit any op then.
+func (es *EPServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+  if !es.getStatus().MajorityUp {
+    http.Error(w, "no majority reachable", http.StatusServiceUnavailable)
+    return
+  }
+  w.Write([]byte("ok\n"))
+}
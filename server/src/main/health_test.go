@@ -0,0 +1,68 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http/httptest"
+  "paxos"
+  "testing"
+  "time"
+)
+
+// checkHealth fetches /status and /healthz from es, and fails unless
+// they agree on whether a majority is up and the peers are in states.
+func checkHealth(t *testing.T, es *EPServer, states ...string) {
+  w := httptest.NewRecorder()
+  es.serveStatus(w, httptest.NewRequest("GET", "/status", nil))
+  var st ReplicaStatus
+  if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+    t.Fatalf("/status of replica %v: %v", es.me, err)
+  }
+  up := 0
+  for i, pi := range st.Peers {
+    if pi.State != states[i] {
+      t.Fatalf("replica %v sees peer %v %v, want %v", es.me, i, pi.State,
+               states[i])
+    }
+    if pi.State == "up" {
+      up++
+    }
+  }
+  majority := up > len(states)/2
+  if st.Replica != es.me || st.MajorityUp != majority {
+    t.Fatalf("/status of replica %v: %+v", es.me, st)
+  }
+
+  w = httptest.NewRecorder()
+  es.serveHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+  if majority && (w.Code != 200 || w.Body.String() != "ok\n") {
+    t.Fatalf("/healthz of replica %v: %v %q", es.me, w.Code, w.Body.String())
+  }
+  if !majority && w.Code != 503 {
+    t.Fatalf("/healthz of cut off replica %v: %v", es.me, w.Code)
+  }
+}
+
+func TestHealth(t *testing.T) {
+  fmt.Printf("Test: Status and health of idle replicas ...\n")
+
+  nw := paxos.NewMemNetwork()
+  esa := makeReplicasWith("health", 3, ServerConfig{
+    RPCTimeout: 50 * time.Millisecond,
+    Transport: nw.Transport,
+  })
+  defer cleanup(esa)
+
+  // no replica has sent a paxos message yet
+  checkHealth(t, esa[1], "up", "up", "up")
+
+  // replica 0 is cut off while idle
+  nw.Disconnect(testPort("health", 0))
+  checkHealth(t, esa[0], "up", "down", "down")
+  checkHealth(t, esa[2], "down", "up", "up")
+
+  nw.Reconnect(testPort("health", 0))
+  checkHealth(t, esa[0], "up", "up", "up")
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,443 @@
+package main
+
+//
+// The HTTP API, for clients that cannot keep a WebSocket open:
+//
+//   GET    /api/pads/            -> []PadSummary
+//   POST   /api/pads/<id>/ops     BatchMsg -> AckMsg, once committed
+//   GET    /api/pads/<id>/ops     ?since=<rev>&wait=<duration> -> PadInfo
+//   GET    /api/pads/<id>/events  ?since=<rev> -> Server-Sent Events
+//   GET    /api/pads/<id>/text    -> the text, at revision X-Pad-Revision
+//   DELETE /api/pads/<id>         -> 204, once the deletion is committed
+//
+// GET .../ops answers with the ops committed from revision since on,
+// waiting up to wait (a Go duration, e.g. 25s) for one if there are
+// none yet. GET .../events streams an "init_comt_op" event with the
+// PadInfo since revision since, then an "op" event per committed op.
+// Each event's id is the revision after it, so a reconnecting
+// EventSource resumes where it stopped through Last-Event-ID. The
+// stream ends with a "pad deleted" event if the pad is deleted.
+// Only owners may delete a pad. Failures are answered with an
+// ErrorMsg and a matching status.
+//
+
+import (
+  "fmt"
+  "io"
+  "net"
+  "sync"
+  "time"
+  "strconv"
+  "strings"
+  "net/http"
+  "encoding/json"
+)
+
+const API_PREFIX = "/api/pads/"
+const API_MAX_BODY = 4 << 20          // bytes of a POSTed batch
+const API_MAX_WAIT = 60 * time.Second // of a long-poll
+const API_MAX_POSTERS = 10000         // rate limiters kept
+const SSE_PING = 15 * time.Second     // keeps idle streams open
+                                      // through proxies
+
+// HTTP status of each error code
+var apiStatus = map[string]int{
+  ErrInvalid:         http.StatusBadRequest,
+  ErrUnknownOpType:   http.StatusBadRequest,
+  ErrUnauthorized:    http.StatusUnauthorized,
+  ErrAccessDenied:    http.StatusForbidden,
+  ErrReadOnly:        http.StatusForbidden,
+  ErrUnknownLink:     http.StatusNotFound,
+  ErrUnknownRevision: http.StatusConflict,
+  ErrCompacted:       http.StatusGone,
+  ErrLimit:           http.StatusTooManyRequests,
+  ErrAuthDisabled:    http.StatusForbidden,
+  ErrPadDeleted:      http.StatusGone,
+}
+
+// PadSummary describes a pad in the list of pads.
+type PadSummary struct {
+  PadId    string
+  Revision uint64
+  Size     int // in UTF-16 code units
+}
+
+// httpSub is the Transport of an HTTP request waiting for the ops
+// committed to a pad. It only buffers them; see serveOps() and
+// serveEvents().
+type httpSub struct {
+  es      *EPServer
+  id      string
+  req     *http.Request
+  ops     chan string // "op" arguments
+  lost    chan bool   // closed once ops overflowed
+  deleted chan bool   // closed once the pad is deleted
+  once    sync.Once
+  delOnce sync.Once
+}
+
+func newHTTPSub(es *EPServer, r *http.Request) *httpSub {
+  sub := &httpSub{es: es, req: r}
+  sub.id = fmt.Sprintf("http-%v", nrand())
+  sub.ops = make(chan string, WS_QUEUE_LEN)
+  sub.lost = make(chan bool)
+  sub.deleted = make(chan bool)
+  return sub
+}
+
+func (s *httpSub) Id() string {
+  return s.id
+}
+
+func (s *httpSub) Request() *http.Request {
+  return s.req
+}
+
+func (s *httpSub) Emit(event string, arg string) {
+  if event == "pad deleted" {
+    s.delOnce.Do(func() { close(s.deleted) })
+    return
+  }
+  if event != "op" {
+    return
+  }
+  select {
+  case s.ops <- arg:
+  default:
+    s.once.Do(func() { close(s.lost) })
+  }
+}
+
+func (s *httpSub) Join(padId string) {
+  s.es.hub.join(padId, s)
+}
+
+// EPServer::serveAPI():
+// HTTP handler for API_PREFIX.
+func (es *EPServer) serveAPI(w http.ResponseWriter, r *http.Request) {
+  // pad ids may hold slashes, but not end in a resource name
+  id := strings.TrimPrefix(r.URL.Path, API_PREFIX)
+  what := ""
+  if slash := strings.LastIndex(id, "/"); slash > 0 {
+    switch id[slash+1:] {
+    case "ops", "events", "text":
+      id, what = id[:slash], id[slash+1:]
+    }
+  }
+
+  user := ""
+  if es.auth != nil {
+    var err error
+    user, err = es.auth.Authenticate(r)
+    if err != nil {
+      writeAPIError(w, protoErrorf(ErrUnauthorized, "unauthorized: %v", err))
+      return
+    }
+  }
+
+  switch {
+  case id == "" && r.Method == "GET":
+    writeAPIJSON(w, es.listPads(user))
+  case id == "":
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  case what == "" && r.Method == "DELETE":
+    es.serveDelete(w, r, id, user)
+  case what == "text" && r.Method == "GET":
+    es.serveText(w, r, id, user)
+  case what == "ops" && r.Method == "POST":
+    es.servePost(w, r, id, user)
+  case what == "ops" && r.Method == "GET":
+    es.serveOps(w, r, id, user)
+  case what == "events" && r.Method == "GET":
+    es.serveEvents(w, r, id, user)
+  case what == "":
+    http.NotFound(w, r)
+  default:
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+// EPServer::serveText():
+// Answers with the text of pad id.
+func (es *EPServer) serveText(w http.ResponseWriter, r *http.Request,
+                              id string, user string) {
+  pad, _, err := es.admit(id, user, false, false)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  text, rev := es.readPad(pad).textAt()
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  w.Header().Set("X-Pad-Revision", strconv.FormatUint(rev, 10))
+  io.WriteString(w, text)
+}
+
+// EPServer::serveDelete():
+// Deletes pad id, which only its owners may do. Without
+// authentication anybody would be an owner, so nobody may.
+func (es *EPServer) serveDelete(w http.ResponseWriter, r *http.Request,
+                                id string, user string) {
+  if es.auth == nil {
+    writeAPIError(w, protoErrorf(ErrAuthDisabled, "authentication disabled"))
+    return
+  }
+  pad, readOnly, err := es.admit(id, user, false, true)
+  if err == nil && (readOnly || !es.authorize(pad, user, RoleOwner)) {
+    err = protoErrorf(ErrAccessDenied, "access denied")
+  }
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  es.deletePad(pad, user)
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// EPServer::servePost():
+// Commits the BatchMsg in the body of r to pad id. A single op is
+// committed as by an "op" message, several as by an "op batch".
+func (es *EPServer) servePost(w http.ResponseWriter, r *http.Request,
+                              id string, user string) {
+  body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+  if err != nil {
+    writeAPIError(w, protoErrorf(ErrLimit, "body too large"))
+    return
+  }
+  ops, ref, err := decodeBatch(true, string(body))
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  pad, _, err := es.admit(id, user, true, true)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  pm, err := es.awaitRevision(pad, ops[0].Version)
+  if err == nil {
+    err = pm.checkVersion(ops[0].Version)
+  }
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  ss := &Session{PadId: pad, User: user, limiter: es.posterLimiter(r, user)}
+  if err := es.checkBatchLimits(ss, ops); err != nil {
+    es.log.Info("batch refused", "pad", pad, "err", err)
+    writeAPIError(w, protoErrorf(ErrLimit, "%v", err))
+    return
+  }
+  var cops []Op
+  if len(ops) == 1 {
+    cops = []Op{es.processOp(pad, ops[0])}
+  } else {
+    cops = es.processBatch(pad, ops)
+  }
+  writeAPIJSON(w, AckMsg{ref, toStringOps(cops)})
+}
+
+// EPServer::serveOps():
+// Answers with the ops committed to pad id from revision since on,
+// waiting for some if there are none yet.
+func (es *EPServer) serveOps(w http.ResponseWriter, r *http.Request,
+                             id string, user string) {
+  since, err := parseRevision(r.URL.Query().Get("since"))
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  wait := time.Duration(0)
+  if s := r.URL.Query().Get("wait"); s != "" {
+    wait, err = time.ParseDuration(s)
+    if err != nil || wait < 0 {
+      writeAPIError(w, protoErrorf(ErrInvalid, "invalid wait %q", s))
+      return
+    }
+    if wait > API_MAX_WAIT {
+      wait = API_MAX_WAIT
+    }
+  }
+  pad, readOnly, err := es.admit(id, user, false, false)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+
+  // subscribe first, so no op slips between the looks at the pad
+  sub := newHTTPSub(es, r)
+  sub.Join(pad)
+  defer es.hub.leave(sub)
+  pm, err := es.awaitRevision(pad, since)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  pi := pm.getInfoSince(since)
+  if len(pi.Ops) == 0 && !pi.Snapshot && wait > 0 {
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case <-sub.ops:
+    case <-sub.lost:
+    case <-timer.C:
+    case <-sub.deleted:
+    case <-r.Context().Done():
+      return
+    }
+    // the pad may have been created meanwhile, or deleted, in which
+    // case sub was told so before the pad was dropped
+    pm = es.readPad(pad)
+    select {
+    case <-sub.deleted:
+      writeAPIError(w, protoErrorf(ErrPadDeleted, "pad deleted"))
+      return
+    default:
+    }
+    pi = pm.getInfoSince(since)
+  }
+  if readOnly {
+    // do not leak the editable id
+    pi.PadId = id
+  }
+  writeAPIJSON(w, pi)
+}
+
+// EPServer::serveEvents():
+// Streams the ops committed to pad id as Server-Sent Events, from
+// revision since on, until the client goes away or falls too far
+// behind.
+func (es *EPServer) serveEvents(w http.ResponseWriter, r *http.Request,
+                                id string, user string) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+    return
+  }
+  s := r.URL.Query().Get("since")
+  if last := r.Header.Get("Last-Event-ID"); last != "" {
+    s = last
+  }
+  since, err := parseRevision(s)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  pad, readOnly, err := es.admit(id, user, false, false)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+
+  sub := newHTTPSub(es, r)
+  sub.Join(pad)
+  defer es.hub.leave(sub)
+  pm, err := es.awaitRevision(pad, since)
+  if err != nil {
+    writeAPIError(w, err)
+    return
+  }
+  pi := pm.getInfoSince(since)
+  if readOnly {
+    pi.PadId = id
+  }
+  piJSON, err := json.Marshal(pi)
+  assert(err == nil, "serveEvents")
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  writeEvent(w, pi.Version, "init_comt_op", string(piJSON))
+  flusher.Flush()
+
+  // ops broadcast before pi was taken may be queued too
+  next := pi.Version
+  ping := time.NewTicker(SSE_PING)
+  defer ping.Stop()
+  for {
+    select {
+    case arg := <-sub.ops:
+      var op SOp
+      err := json.Unmarshal([]byte(arg), &op)
+      assert(err == nil, "serveEvents - op")
+      if op.Version < next {
+        continue
+      }
+      next = op.Version + 1
+      writeEvent(w, next, "op", arg)
+    case <-ping.C:
+      io.WriteString(w, ": ping\n\n")
+    case <-sub.lost:
+      es.log.Info("event stream too slow, closing", "pad", pad)
+      return
+    case <-sub.deleted:
+      msgJSON, err := json.Marshal(PadDeletedMsg{})
+      assert(err == nil, "serveEvents - deleted")
+      writeEvent(w, next, "pad deleted", string(msgJSON))
+      flusher.Flush()
+      return
+    case <-r.Context().Done():
+      return
+    }
+    flusher.Flush()
+  }
+}
+
+// EPServer::posterLimiter():
+// Returns the rate limiter of the HTTP client r comes from, by user,
+// or by address when authentication is disabled. Nil if ops are not
+// rate limited.
+func (es *EPServer) posterLimiter(r *http.Request, user string) *rateLimiter {
+  if es.limits.OpRate <= 0 {
+    return nil
+  }
+  key := user
+  if es.auth == nil {
+    key, _, _ = net.SplitHostPort(r.RemoteAddr)
+  }
+  es.mu.Lock()
+  defer es.mu.Unlock()
+  lim, ok := es.posters[key]
+  if !ok {
+    // forgetting the rest only refills their buckets
+    if len(es.posters) >= API_MAX_POSTERS {
+      es.posters = make(map[string]*rateLimiter)
+    }
+    lim = newRateLimiter(es.limits.OpRate, es.limits.OpBurst)
+    es.posters[key] = lim
+  }
+  return lim
+}
+
+func parseRevision(s string) (uint64, error) {
+  if s == "" {
+    return 0, nil
+  }
+  rev, err := strconv.ParseUint(s, 10, 64)
+  if err != nil {
+    return 0, protoErrorf(ErrInvalid, "invalid revision %q", s)
+  }
+  return rev, nil
+}
+
+func writeEvent(w io.Writer, id uint64, event string, data string) {
+  fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %v\n\n", id, event, data)
+}
+
+func writeAPIJSON(w http.ResponseWriter, v interface{}) {
+  data, err := json.Marshal(v)
+  assert(err == nil, "writeAPIJSON")
+  w.Header().Set("Content-Type", "application/json")
+  w.Write(data)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+  code := errorCode(err, ErrInvalid)
+  status, ok := apiStatus[code]
+  if !ok {
+    status = http.StatusBadRequest
+  }
+  data, jerr := json.Marshal(ErrorMsg{code, err.Error(), 0})
+  assert(jerr == nil, "writeAPIError")
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  w.Write(data)
+}
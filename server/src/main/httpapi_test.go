@@ -0,0 +1,361 @@
+package main
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+func postOp(t *testing.T, url string, body string) (int, string) {
+  resp, err := http.Post(url, "application/json", strings.NewReader(body))
+  if err != nil {
+    t.Fatalf("POST %v: %v", url, err)
+  }
+  defer resp.Body.Close()
+  data, _ := io.ReadAll(resp.Body)
+  return resp.StatusCode, string(data)
+}
+
+func getInfo(t *testing.T, url string) PadInfo {
+  resp, err := http.Get(url)
+  if err != nil {
+    t.Fatalf("GET %v: %v", url, err)
+  }
+  defer resp.Body.Close()
+  var pi PadInfo
+  if err := json.NewDecoder(resp.Body).Decode(&pi); err != nil {
+    t.Fatalf("GET %v: %v", url, err)
+  }
+  return pi
+}
+
+func TestHTTPOps(t *testing.T) {
+  fmt.Printf("Test: Ops over HTTP, with long-polling ...\n")
+
+  esa := makeReplicas(t, "httpops", 3, 4)
+  defer cleanup(esa)
+  srv := httptest.NewServer(http.HandlerFunc(esa[0].serveAPI))
+  defer srv.Close()
+  url := srv.URL + API_PREFIX + "pad/ops"
+
+  status, body := postOp(t, url, `{"Ref": 3, "Ops": [{"ID": 1, ` +
+    `"Version": 0, "Type": "Insert", "Position": 0, "Value": "a"}]}`)
+  if status != http.StatusOK || !strings.Contains(body, `"Ref":3`) {
+    t.Fatalf("POST: got %v %v", status, body)
+  }
+  pi := getInfo(t, url+"?since=0")
+  if pi.Version != 1 || len(pi.Ops) != 1 || pi.Ops[0].Value != "a" {
+    t.Fatalf("GET since 0: got %+v", pi)
+  }
+
+  // a long-poll is answered once an op is committed
+  done := make(chan PadInfo)
+  go func() {
+    done <- getInfo(t, url+"?since=1&wait=10s")
+  }()
+  time.Sleep(100 * time.Millisecond)
+  postOp(t, url, `{"Ops": [{"ID": 1, "Version": 1, "Type": "Insert", ` +
+                 `"Position": 1, "Value": "b"}]}`)
+  select {
+  case pi := <-done:
+    if pi.Version != 2 || len(pi.Ops) != 1 || pi.Ops[0].Value != "b" {
+      t.Fatalf("long-poll: got %+v", pi)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("long-poll not answered")
+  }
+  // and times out empty otherwise
+  pi = getInfo(t, url+"?since=2&wait=10ms")
+  if pi.Version != 2 || len(pi.Ops) != 0 {
+    t.Fatalf("idle long-poll: got %+v", pi)
+  }
+
+  bad := []struct {
+    method string
+    path   string
+    body   string
+    status int
+  }{
+    {"POST", "pad/ops", `{"Ops": []}`, http.StatusBadRequest},
+    {"POST", "pad/ops", `{"Ops": [{"Type": "Move"}]}`, http.StatusBadRequest},
+    {"POST", "ro-none/ops", `{"Ops": [{"Type": "Insert"}]}`,
+     http.StatusNotFound},
+    {"GET", "pad/ops?since=9", "", http.StatusConflict},
+    {"GET", "pad/ops?since=x", "", http.StatusBadRequest},
+    {"PUT", "pad/ops", "", http.StatusMethodNotAllowed},
+    {"GET", "pad/other", "", http.StatusNotFound},
+  }
+  for _, b := range bad {
+    req, _ := http.NewRequest(b.method, srv.URL+API_PREFIX+b.path,
+                              strings.NewReader(b.body))
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatalf("%v %v: %v", b.method, b.path, err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != b.status {
+      t.Fatalf("%v %v: got %v, want %v", b.method, b.path,
+               resp.StatusCode, b.status)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestHTTPEvents(t *testing.T) {
+  fmt.Printf("Test: Server-Sent Events of committed ops ...\n")
+
+  esa := makeReplicas(t, "httpevents", 3, 4)
+  defer cleanup(esa)
+  srv := httptest.NewServer(http.HandlerFunc(esa[0].serveAPI))
+  defer srv.Close()
+  url := srv.URL + API_PREFIX + "pad/"
+
+  postOp(t, url+"ops", `{"Ops": [{"ID": 1, "Version": 0, ` +
+                       `"Type": "Insert", "Position": 0, "Value": "a"}]}`)
+
+  // resuming after the first op
+  req, _ := http.NewRequest("GET", url+"events", nil)
+  req.Header.Set("Last-Event-ID", "1")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatalf("GET events: %v", err)
+  }
+  defer resp.Body.Close()
+  if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+    t.Fatalf("Content-Type %q", ct)
+  }
+  events := make(chan []string)
+  go func() {
+    rd := bufio.NewReader(resp.Body)
+    var ev []string
+    for {
+      line, err := rd.ReadString('\n')
+      if err != nil {
+        close(events)
+        return
+      }
+      line = strings.TrimSuffix(line, "\n")
+      if line != "" {
+        ev = append(ev, line)
+      } else if len(ev) > 0 {
+        events <- ev
+        ev = nil
+      }
+    }
+  }()
+  next := func() []string {
+    select {
+    case ev := <-events:
+      return ev
+    case <-time.After(5 * time.Second):
+      t.Fatalf("no event")
+    }
+    return nil
+  }
+
+  ev := next()
+  if len(ev) != 3 || ev[0] != "id: 1" || ev[1] != "event: init_comt_op" ||
+     !strings.Contains(ev[2], `"Ops":[]`) {
+    t.Fatalf("init: got %v", ev)
+  }
+  postOp(t, url+"ops", `{"Ops": [{"ID": 2, "Version": 1, ` +
+                       `"Type": "Insert", "Position": 1, "Value": "b"}]}`)
+  ev = next()
+  want := []string{"id: 2", "event: op", `data: {"ID":2,"Version":1,` +
+                   `"Type":"Insert","Position":1,"Value":"b"}`}
+  if strings.Join(ev, "\n") != strings.Join(want, "\n") {
+    t.Fatalf("op: got %v, want %v", ev, want)
+  }
+
+  // without authentication nobody may delete the pad over HTTP
+  req, _ = http.NewRequest("DELETE", srv.URL+API_PREFIX+"pad", nil)
+  resp, err = http.DefaultClient.Do(req)
+  if err != nil || resp.StatusCode != http.StatusForbidden {
+    t.Fatalf("DELETE without authentication: got %v, %v", resp, err)
+  }
+  resp.Body.Close()
+
+  // the stream ends when the pad is deleted
+  esa[0].deletePad("pad", "")
+  ev = next()
+  if len(ev) != 3 || ev[1] != "event: pad deleted" {
+    t.Fatalf("delete: got %v", ev)
+  }
+  if ev, ok := <-events; ok {
+    t.Fatalf("event after delete: %v", ev)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPadAdmin(t *testing.T) {
+  fmt.Printf("Test: Listing, reading and deleting pads ...\n")
+
+  ta := NewTokenAuthenticator([]byte("secret"))
+  esa := makeReplicasWith("padadmin", 3, ServerConfig{Auth: ta})
+  defer cleanup(esa)
+  srv := httptest.NewServer(http.HandlerFunc(esa[0].serveAPI))
+  defer srv.Close()
+  url := srv.URL + API_PREFIX
+  do := func(user string, method string, path string,
+             body string) *http.Response {
+    req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+    req.Header.Set("Authorization", "Bearer "+ta.MintToken(user, time.Hour))
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatalf("%v %v: %v", method, path, err)
+    }
+    return resp
+  }
+
+  do("alice", "POST", "b/ops", `{"Ops": [{"ID": 1, "Version": 0, ` +
+     `"Type": "Insert", "Position": 0, "Value": "😀x"}]}`).Body.Close()
+  do("alice", "POST", "a/ops", `{"Ops": [{"ID": 1, "Version": 0, ` +
+     `"Type": "Insert", "Position": 0, "Value": "y"}]}`).Body.Close()
+  resp := do("alice", "GET", "", "")
+  var pads []PadSummary
+  json.NewDecoder(resp.Body).Decode(&pads)
+  resp.Body.Close()
+  want := []PadSummary{{"a", 1, 1}, {"b", 1, 3}}
+  if !reflect.DeepEqual(pads, want) {
+    t.Fatalf("list: got %+v, want %+v", pads, want)
+  }
+
+  resp = do("alice", "GET", "b/text", "")
+  text, _ := io.ReadAll(resp.Body)
+  resp.Body.Close()
+  if string(text) != "😀x" || resp.Header.Get("X-Pad-Revision") != "1" {
+    t.Fatalf("text: got %q at %v", text,
+             resp.Header.Get("X-Pad-Revision"))
+  }
+
+  // only its owner may delete it
+  resp = do("bob", "DELETE", "b", "")
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusForbidden {
+    t.Fatalf("DELETE by another user: got %v", resp.StatusCode)
+  }
+  resp = do("alice", "DELETE", "b", "")
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusNoContent {
+    t.Fatalf("DELETE: got %v", resp.StatusCode)
+  }
+  catchUp(t, esa)
+  for _, es := range esa {
+    if _, ok := es.pads["b"]; ok {
+      t.Fatalf("replica %v still holds the deleted pad", es.me)
+    }
+  }
+  checkSame(t, esa)
+
+  // an op checked against the deleted pad commits as a noop
+  cop := esa[1].processOp("b", Op{ID: 1, Version: 1, Type: InsertOp,
+                                  Position: 0, Value: "z"})
+  if cop.Type != NoOp || esa[1].getPadById("b").revision() != 0 {
+    t.Fatalf("stale op committed as %+v", cop)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// Viewers that opened a pad through its read-only alias are told it
+// was deleted without learning its id.
+func TestDeleteSeenByViewer(t *testing.T) {
+  fmt.Printf("Test: Viewers of a deleted pad never see its id ...\n")
+
+  esa := makeReplicas(t, "delviewer", 3, 4)
+  defer cleanup(esa)
+  srv := httptest.NewServer(http.HandlerFunc(esa[0].serveAPI))
+  defer srv.Close()
+
+  alias := esa[0].shareLink("secret")
+  viewer := &fakeTransport{es: esa[0], id: "ws-viewer"}
+  newClientConn(esa[0], viewer, ProtoTyped).handle("open pad",
+    `{"PadId": "` + alias + `"}`)
+  resp, err := http.Get(srv.URL + API_PREFIX + alias + "/events")
+  if err != nil {
+    t.Fatalf("GET events: %v", err)
+  }
+  defer resp.Body.Close()
+
+  esa[0].deletePad("secret", "")
+  // the stream ends with the deletion
+  stream, _ := io.ReadAll(resp.Body)
+  sent := append(viewer.take(), string(stream))
+  all := strings.Join(sent, "\n")
+  if !strings.Contains(string(stream), "event: pad deleted\ndata: {}\n") ||
+     !strings.Contains(sent[len(sent)-2], "pad deleted {}") {
+    t.Fatalf("deletion not seen: %v", all)
+  }
+  if strings.Contains(all, "secret") {
+    t.Fatalf("viewer was sent the pad id: %v", all)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// Reads neither create a pad nor claim it; the first to edit it owns
+// it.
+func TestReadsClaimNothing(t *testing.T) {
+  fmt.Printf("Test: Reading a pad neither creates nor claims it ...\n")
+
+  ta := NewTokenAuthenticator([]byte("secret"))
+  esa := makeReplicasWith("readclaim", 3, ServerConfig{Auth: ta})
+  defer cleanup(esa)
+  srv := httptest.NewServer(http.HandlerFunc(esa[0].serveAPI))
+  defer srv.Close()
+  url := srv.URL + API_PREFIX + "fresh/"
+  do := func(user string, method string, path string, body string) int {
+    req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+    req.Header.Set("Authorization", "Bearer "+ta.MintToken(user, time.Hour))
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatalf("%v %v: %v", method, path, err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+  }
+
+  for _, path := range []string{"text", "ops?since=0"} {
+    if status := do("crawler", "GET", path, ""); status != http.StatusOK {
+      t.Fatalf("GET %v: got %v", path, status)
+    }
+  }
+  ctx, cancel := context.WithCancel(context.Background())
+  req, _ := http.NewRequestWithContext(ctx, "GET", url+"events", nil)
+  req.Header.Set("Authorization", "Bearer "+ta.MintToken("crawler", time.Hour))
+  if resp, err := http.DefaultClient.Do(req); err != nil ||
+     resp.StatusCode != http.StatusOK {
+    t.Fatalf("GET events: got %v, %v", resp, err)
+  }
+  cancel()
+  catchUp(t, esa)
+  for _, es := range esa {
+    if _, ok := es.pads["fresh"]; ok {
+      t.Fatalf("replica %v created the pad on a read", es.me)
+    }
+  }
+
+  status := do("alice", "POST", "ops", `{"Ops": [{"ID": 1, "Version": 0, ` +
+                                  `"Type": "Insert", "Position": 0, "Value": "a"}]}`)
+  if status != http.StatusOK {
+    t.Fatalf("POST: got %v", status)
+  }
+  if role := esa[0].getPadById("fresh").roleOf("alice"); role != RoleOwner {
+    t.Fatalf("the first editor holds %v", roleName(role))
+  }
+  if status := do("crawler", "GET", "text", ""); status != http.StatusForbidden {
+    t.Fatalf("GET by a stranger once claimed: got %v", status)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+  "sync"
+)
+
+// hub is the Broadcaster of transports that have no pad rooms of their
+// own, like WebSocket and HTTP clients. Every EPServer has one.
+type hub struct {
+  mu    sync.Mutex
+  rooms map[string]map[string]Transport // pad id -> connection id -> member
+}
+
+func newHub() *hub {
+  return &hub{rooms: make(map[string]map[string]Transport)}
+}
+
+// hub::join()
+// Makes t receive what is broadcast to pad padId. t.Emit() must not
+// block, as broadcasts are sent while committing.
+func (h *hub) join(padId string, t Transport) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  room, ok := h.rooms[padId]
+  if !ok {
+    room = make(map[string]Transport)
+    h.rooms[padId] = room
+  }
+  room[t.Id()] = t
+}
+
+// hub::leave()
+// Removes t from every room it joined.
+func (h *hub) leave(t Transport) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for padId, room := range h.rooms {
+    delete(room, t.Id())
+    if len(room) == 0 {
+      delete(h.rooms, padId)
+    }
+  }
+}
+
+func (h *hub) Broadcast(padId string, event string, arg string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for _, t := range h.rooms[padId] {
+    t.Emit(event, arg)
+  }
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "unicode/utf16"
+)
+
+// Limits protect the paxos log from misbehaving clients. They are
+// enforced by the replica a client is connected to, before an op is
+// proposed. A zero value disables the corresponding limit.
+type Limits struct {
+  OpRate      float64 // sustained ops per second per socket
+  OpBurst     int     // ops a socket may send at once above OpRate
+  MaxPadSize  int     // maximum length of a pad's text, in code units
+  MaxValueLen int     // maximum length of a single op's Value, in code
+                      // units
+  MaxBatchLen int     // maximum number of ops in a batch
+}
+
+// rateLimiter is a token bucket refilled at rate tokens per second and
+// holding at most burst tokens.
+type rateLimiter struct {
+  mu     sync.Mutex
+  rate   float64
+  burst  float64
+  tokens float64
+  last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+  if burst < 1 {
+    burst = 1
+  }
+  rl := &rateLimiter{}
+  rl.rate = rate
+  rl.burst = float64(burst)
+  rl.tokens = rl.burst
+  rl.last = time.Now()
+  return rl
+}
+
+// rateLimiter::allow():
+// Takes a token from the bucket if there is one.
+func (rl *rateLimiter) allow() bool {
+  rl.mu.Lock()
+  defer rl.mu.Unlock()
+
+  now := time.Now()
+  rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+  if rl.tokens > rl.burst {
+    rl.tokens = rl.burst
+  }
+  rl.last = now
+  if rl.tokens < 1 {
+    return false
+  }
+  rl.tokens--
+  return true
+}
+
+// EPServer::checkLimits():
+// Returns an error describing the first limit op would exceed if it
+// was submitted through the socket of session ss, or nil.
+func (es *EPServer) checkLimits(ss *Session, op Op) error {
+  return es.checkBatchLimits(ss, []Op{op})
+}
+
+// EPServer::checkBatchLimits():
+// Like checkLimits(), for ops submitted together. A batch counts as a
+// single op against the rate limit.
+func (es *EPServer) checkBatchLimits(ss *Session, ops []Op) error {
+  lim := es.limits
+  if ss.limiter != nil && !ss.limiter.allow() {
+    return fmt.Errorf("rate limit exceeded: at most %v ops per second",
+                      lim.OpRate)
+  }
+  if lim.MaxBatchLen > 0 && len(ops) > lim.MaxBatchLen {
+    return fmt.Errorf("batch too large: at most %v ops", lim.MaxBatchLen)
+  }
+  grow := 0
+  for _, op := range ops {
+    if lim.MaxValueLen > 0 &&
+       len(utf16.Encode([]rune(op.Value))) > lim.MaxValueLen {
+      return fmt.Errorf("op too large: Value is limited to %v UTF-16 " +
+                        "code units", lim.MaxValueLen)
+    }
+    if op.Type == InsertOp {
+      grow += int(op.length())
+    }
+  }
+  if lim.MaxPadSize > 0 && grow > 0 {
+    size := es.getPadById(ss.PadId).size()
+    if size+grow > lim.MaxPadSize {
+      return fmt.Errorf("pad too large: documents are limited to %v " +
+                        "UTF-16 code units", lim.MaxPadSize)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+  "testing"
+  "time"
+)
+
+// rewind makes rl believe d has passed since it last refilled.
+func rewind(rl *rateLimiter, d time.Duration) {
+  rl.mu.Lock()
+  defer rl.mu.Unlock()
+  rl.last = rl.last.Add(-d)
+}
+
+// allowed returns how many tokens rl hands out right away.
+func allowed(rl *rateLimiter) int {
+  n := 0
+  for rl.allow() {
+    n++
+  }
+  return n
+}
+
+func TestRateLimiter(t *testing.T) {
+  fmt.Printf("Test: Token bucket rate limiter ...\n")
+
+  rl := newRateLimiter(10, 3)
+  if n := allowed(rl); n != 3 {
+    t.Fatalf("burst of %v, want 3", n)
+  }
+  rewind(rl, 200 * time.Millisecond)
+  if n := allowed(rl); n != 2 {
+    t.Fatalf("%v refilled after 200ms at 10/s, want 2", n)
+  }
+  // refills up to the burst only
+  rewind(rl, 10 * time.Second)
+  if n := allowed(rl); n != 3 {
+    t.Fatalf("%v refilled after 10s, want the burst of 3", n)
+  }
+  if n := allowed(newRateLimiter(10, 0)); n != 1 {
+    t.Fatalf("burst of %v with none given, want 1", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCheckLimits(t *testing.T) {
+  fmt.Printf("Test: Op limits ...\n")
+
+  lim := Limits{OpRate: 1, OpBurst: 2, MaxPadSize: 10, MaxValueLen: 4,
+                MaxBatchLen: 3}
+  esa := makeReplicasWith("limits", 3, ServerConfig{Limits: lim})
+  defer cleanup(esa)
+  es := esa[0]
+  es.processOp("pad", insertOp(1, "abcd"))
+
+  ins := func(value string) Op {
+    return Op{ID: 2, Version: 1, Type: InsertOp, Position: 0, Value: value}
+  }
+  del := Op{ID: 2, Version: 1, Type: DeleteOp, Position: 0, Value: "abcde"}
+  cases := []struct {
+    ops []Op
+    err string // in the error, if any
+  }{
+    {[]Op{ins("ab")}, ""},
+    // Values count UTF-16 code units, not bytes
+    {[]Op{ins("😀😀")}, ""},
+    {[]Op{ins("😀😀a")}, "op too large"},
+    {[]Op{ins("abcde")}, "op too large"},
+    {[]Op{del}, "op too large"},
+    {[]Op{{ID: 2, Version: 1, Type: DeleteOp, Position: 0}}, ""},
+    {[]Op{ins("abc"), ins("abc")}, ""},
+    {[]Op{ins("abc"), ins("abcd")}, "pad too large"},
+    {[]Op{ins(""), ins(""), ins(""), ins("")}, "batch too large"},
+  }
+  for _, c := range cases {
+    ss := &Session{PadId: "pad"}
+    err := es.checkBatchLimits(ss, c.ops)
+    if (c.err == "" && err != nil) ||
+       (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+      t.Fatalf("%v ops, first %v: got %v, want %q", len(c.ops),
+               opString(c.ops[0]), err, c.err)
+    }
+  }
+
+  // every socket has a bucket of its own, and a batch takes one token
+  es.socketCheckIn("a", "pad", "", false)
+  es.socketCheckIn("b", "pad", "", false)
+  a, _ := es.lookupSession("a")
+  b, _ := es.lookupSession("b")
+  batch := []Op{ins("a"), ins("b")}
+  for i := 0; i < 2; i++ {
+    if err := es.checkBatchLimits(a, batch); err != nil {
+      t.Fatalf("batch %v within the burst: %v", i, err)
+    }
+  }
+  if err := es.checkLimits(a, ins("a")); err == nil ||
+     !strings.Contains(err.Error(), "rate limit") {
+    t.Fatalf("op over the rate: got %v", err)
+  }
+  if err := es.checkLimits(b, ins("a")); err != nil {
+    t.Fatalf("other socket: %v", err)
+  }
+
+  // and so has every HTTP client
+  r1 := &http.Request{RemoteAddr: "10.0.0.1:1000"}
+  r2 := &http.Request{RemoteAddr: "10.0.0.2:1000"}
+  l1 := es.posterLimiter(r1, "")
+  if allowed(l1) != 2 || es.posterLimiter(r1, "") != l1 {
+    t.Fatalf("HTTP client does not keep its limiter")
+  }
+  if n := allowed(es.posterLimiter(r2, "")); n != 2 {
+    t.Fatalf("other HTTP client allowed %v, want 2", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
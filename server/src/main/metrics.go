@@ -0,0 +1,214 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "paxos"
+)
+
+// Metrics are exported in the Prometheus text exposition format on
+// /metrics. Everything that needs es.mu is mirrored here, so that a
+// scrape never waits for a paxos round in progress.
+
+var latencyBuckets = []float64{
+  .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+type Histogram struct {
+  bounds []float64
+  counts []uint64 // counts[i] observations <= bounds[i]; last is +Inf
+  sum    float64
+  total  uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+  h := &Histogram{}
+  h.bounds = bounds
+  h.counts = make([]uint64, len(bounds)+1)
+  return h
+}
+
+func (h *Histogram) observe(v float64) {
+  i := sort.SearchFloat64s(h.bounds, v)
+  h.counts[i]++
+  h.sum += v
+  h.total++
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+  cum := uint64(0)
+  for i, b := range h.bounds {
+    cum += h.counts[i]
+    fmt.Fprintf(w, "%v_bucket{%v,le=\"%v\"} %v\n", name, labels, b, cum)
+  }
+  fmt.Fprintf(w, "%v_bucket{%v,le=\"+Inf\"} %v\n", name, labels, h.total)
+  fmt.Fprintf(w, "%v_sum{%v} %v\n", name, labels, h.sum)
+  fmt.Fprintf(w, "%v_count{%v} %v\n", name, labels, h.total)
+}
+
+// roundsHistogram()
+// Returns the decisions of st by the paxos rounds they took.
+func roundsHistogram(st paxos.Stats) *Histogram {
+  bounds := make([]float64, paxos.RoundBuckets-1)
+  for i := range bounds {
+    bounds[i] = float64(i + 1)
+  }
+  h := newHistogram(bounds)
+  for i, n := range st.DecisionRounds {
+    h.counts[i] = uint64(n)
+    h.total += uint64(n)
+  }
+  h.sum = float64(st.RoundsToDecide)
+  return h
+}
+
+// promLabel()
+// Quotes s as a Prometheus label value.
+func promLabel(s string) string {
+  r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+  return `"` + r.Replace(s) + `"`
+}
+
+type Metrics struct {
+  mu            sync.Mutex
+  commitPoint   int
+  openSockets   int
+  padsLoaded    int
+  opsApplied    map[string]uint64 // pad id -> committed ops applied,
+                                  // for the pads held
+  decideLatency *Histogram        // Start() to Decided, in seconds
+}
+
+func newMetrics() *Metrics {
+  m := &Metrics{}
+  m.opsApplied = make(map[string]uint64)
+  m.decideLatency = newHistogram(latencyBuckets)
+  return m
+}
+
+func (m *Metrics) observeDecide(d time.Duration) {
+  m.mu.Lock()
+  m.decideLatency.observe(d.Seconds())
+  m.mu.Unlock()
+}
+
+func (m *Metrics) opApplied(padId string) {
+  m.mu.Lock()
+  m.opsApplied[padId]++
+  m.mu.Unlock()
+}
+
+// Metrics::padDeleted():
+// Drops the series of pad padId, so that there are only as many as
+// pads held.
+func (m *Metrics) padDeleted(padId string) {
+  m.mu.Lock()
+  delete(m.opsApplied, padId)
+  m.mu.Unlock()
+}
+
+func (m *Metrics) setCommitPoint(cp int) {
+  m.mu.Lock()
+  m.commitPoint = cp
+  m.mu.Unlock()
+}
+
+func (m *Metrics) getCommitPoint() int {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  return m.commitPoint
+}
+
+func (m *Metrics) setOpenSockets(n int) {
+  m.mu.Lock()
+  m.openSockets = n
+  m.mu.Unlock()
+}
+
+func (m *Metrics) setPadsLoaded(n int) {
+  m.mu.Lock()
+  m.padsLoaded = n
+  m.mu.Unlock()
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string,
+                 labels string, v interface{}) {
+  fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+  fmt.Fprintf(w, "%v{%v} %v\n", name, labels, v)
+}
+
+// EPServer::serveMetrics():
+// HTTP handler for /metrics.
+func (es *EPServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+  rl := fmt.Sprintf("replica=\"%v\"", es.me)
+
+  st := es.px.Stats()
+  writeMetric(w, "paxos_rounds_total", "counter",
+    "Prepare phases started by this replica's proposers.", rl, st.Rounds)
+  writeMetric(w, "paxos_decisions_total", "counter",
+    "Instances decided by this replica's proposers.", rl, st.Decisions)
+  writeMetric(w, "paxos_prepares_total", "counter",
+    "Prepare messages sent.", rl, st.Prepares)
+  writeMetric(w, "paxos_prepare_rejections_total", "counter",
+    "Prepare messages rejected.", rl, st.PrepareRejects)
+  writeMetric(w, "paxos_accepts_total", "counter",
+    "Accept messages sent.", rl, st.Accepts)
+  writeMetric(w, "paxos_accept_rejections_total", "counter",
+    "Accept messages rejected.", rl, st.AcceptRejects)
+  writeMetric(w, "paxos_decideds_total", "counter",
+    "Decided messages sent.", rl, st.Decideds)
+  writeMetric(w, "paxos_rpc_failures_total", "counter",
+    "Messages to peers that got no reply.", rl, st.RPCFailures)
+  writeMetric(w, "paxos_backoffs_total", "counter",
+    "Rounds delayed after a rejection.", rl, st.Backoffs)
+  writeMetric(w, "paxos_rpcs_total", "counter",
+    "RPCs served.", rl, st.RPCCount)
+  fmt.Fprintf(w, "# HELP paxos_decision_rounds %v\n",
+    "Rounds taken by the instances this replica's proposers decided.")
+  fmt.Fprintf(w, "# TYPE paxos_decision_rounds histogram\n")
+  roundsHistogram(st).write(w, "paxos_decision_rounds", rl)
+
+  max, maxKnown, min := es.px.Max(), es.px.MaxKnown(), es.px.Min()
+  writeMetric(w, "paxos_max_seq", "gauge",
+    "Highest instance proposed by this replica.", rl, max)
+  writeMetric(w, "paxos_max_known_seq", "gauge",
+    "Highest instance known to this replica.", rl, maxKnown)
+  writeMetric(w, "paxos_min_seq", "gauge",
+    "Instances below this have been forgotten.", rl, min)
+
+  m := es.metrics
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  writeMetric(w, "pad_commit_point", "gauge",
+    "Next log instance to be applied.", rl, m.commitPoint)
+  writeMetric(w, "pad_commit_lag", "gauge",
+    "Known log instances not applied yet.", rl, maxKnown+1-m.commitPoint)
+  writeMetric(w, "pad_open_sockets", "gauge",
+    "Sockets that have opened a pad.", rl, m.openSockets)
+  writeMetric(w, "pad_loaded", "gauge",
+    "Pads held in memory.", rl, m.padsLoaded)
+
+  fmt.Fprintf(w, "# HELP pad_decide_latency_seconds %v\n",
+    "Time from proposing a log entry to its decision.")
+  fmt.Fprintf(w, "# TYPE pad_decide_latency_seconds histogram\n")
+  m.decideLatency.write(w, "pad_decide_latency_seconds", rl)
+
+  fmt.Fprintf(w, "# HELP pad_ops_applied_total %v\n",
+    "Committed ops applied, per pad.")
+  fmt.Fprintf(w, "# TYPE pad_ops_applied_total counter\n")
+  pads := make([]string, 0, len(m.opsApplied))
+  for padId := range m.opsApplied {
+    pads = append(pads, padId)
+  }
+  sort.Strings(pads)
+  for _, padId := range pads {
+    fmt.Fprintf(w, "pad_ops_applied_total{%v,pad=%v} %v\n",
+      rl, promLabel(padId), m.opsApplied[padId])
+  }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+  "fmt"
+  "net/http/httptest"
+  "regexp"
+  "strings"
+  "testing"
+)
+
+// scrape returns the lines es serves on /metrics.
+func scrape(t *testing.T, es *EPServer) []string {
+  w := httptest.NewRecorder()
+  es.serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+  if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+    t.Fatalf("Content-Type %q", ct)
+  }
+  return strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+func TestMetrics(t *testing.T) {
+  fmt.Printf("Test: Metrics in the Prometheus text format ...\n")
+
+  esa := makeReplicas(t, "metrics", 3, 4)
+  defer cleanup(esa)
+  const odd = "a\"b\\c\nd"
+  for i := 0; i < 3; i++ {
+    esa[0].processOp(odd, Op{ID: 1, Version: uint64(i), Type: InsertOp,
+                             Value: "x"})
+  }
+  esa[0].processOp("plain", insertOp(1, "y"))
+
+  sample := regexp.MustCompile(`^[a-z_]+\{replica="0"(,[a-z]+="([^"\\]|\\.)*")*\} [-+0-9.eInf]+$`)
+  values := make(map[string]string)
+  for _, line := range scrape(t, esa[0]) {
+    if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+      continue
+    }
+    if !sample.MatchString(line) {
+      t.Fatalf("malformed line %q", line)
+    }
+    at := strings.LastIndex(line, " ")
+    values[line[:at]] = line[at+1:]
+  }
+  want := map[string]string{
+    `pad_ops_applied_total{replica="0",pad="a\"b\\c\nd"}`: "3",
+    `pad_ops_applied_total{replica="0",pad="plain"}`: "1",
+    `pad_loaded{replica="0"}`: "2",
+    `pad_commit_point{replica="0"}`: "4",
+    `paxos_decisions_total{replica="0"}`: "4",
+    // a lone proposer decides in one round
+    `paxos_decision_rounds_bucket{replica="0",le="1"}`: "4",
+    `paxos_decision_rounds_bucket{replica="0",le="7"}`: "4",
+    `paxos_decision_rounds_bucket{replica="0",le="+Inf"}`: "4",
+    `paxos_decision_rounds_sum{replica="0"}`: "4",
+    `paxos_decision_rounds_count{replica="0"}`: "4",
+    `pad_decide_latency_seconds_count{replica="0"}`: "4",
+  }
+  for k, v := range want {
+    if values[k] != v {
+      t.Fatalf("%v is %q, want %v", k, values[k], v)
+    }
+  }
+
+  // a deleted pad takes its series along, on every replica
+  esa[0].deletePad("plain", "")
+  catchUp(t, esa)
+  for _, es := range esa {
+    text := strings.Join(scrape(t, es), "\n")
+    if strings.Contains(text, `pad="plain"`) ||
+       !strings.Contains(text, `pad="a\"b\\c\nd"`) {
+      t.Fatalf("replica %v after deleting a pad:\n%v", es.me, text)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -3,12 +3,19 @@ package main
 import (
   //"log"
   "sync"
+  "unicode"
+  "unicode/utf16"
 )
 
+// PadInfo brings a client up to date with a pad: it applies Ops to
+// its copy of the pad at revision Base, or to Text if Snapshot is set.
 type PadInfo struct {
-  PadId   string
-  Version uint64
-  Ops     []SOp
+  PadId    string
+  Version  uint64 // revision after Ops
+  Base     uint64 // revision Ops apply to
+  Snapshot bool   // the client's copy is too old; start over from Text
+  Text     string // the pad at Base if Snapshot
+  Ops      []SOp
 }
 
 type PadManager struct {
@@ -16,8 +23,24 @@ type PadManager struct {
   mu      sync.Mutex
   padId   string
   rev     uint64
-  text    string
+  text    []uint16 // UTF-16 code units, the unit of Op.Position
   history map[uint64]Op // revision base -> committed Op
+  base     uint64   // revisions before base are compacted away
+  baseText []uint16 // text at revision base
+  keep     int      // revisions kept after compaction; 0 keeps all
+  acl     map[string]int // user id -> role, empty until claimed
+  alias   string         // read-only alias, empty until minted
+  clients map[int64]*clientState // client (op) id -> ops in flight
+  resumed map[int64]uint64       // client id -> revision it last
+                                 // resumed from
+}
+
+// clientState tracks the ops of one client that it may have built
+// further ops on before seeing them committed.
+type clientState struct {
+  seen uint64 // the client has seen every revision before seen
+  own  []Op   // the client's ops committed at revision seen or later,
+              // as the client applies them on top of revision seen
 }
 
 // PadManager::registerOp()
@@ -25,57 +48,221 @@ type PadManager struct {
 // operations (if any), and emits the committed version of the same
 // operation. Assumes that operations are passed in in paxos-log order
 // without duplications.
+//
+// A client may send an op before it has seen its previous ops
+// committed, so opIn applies on top of revision opIn.Version followed
+// by those ops. Those are bridged rather than reconciled with, since
+// opIn already accounts for them.
+//
+// An op older than the history kept cannot be reconciled, and is
+// committed as a noop. Replicas refuse such ops with checkVersion()
+// before proposing them, so this only happens to ops that raced with
+// a compaction.
 func (pm *PadManager) registerOp(opIn Op) Op {
+  return pm.registerBatch([]Op{opIn})[0]
+}
+
+// PadManager::registerBatch()
+// Like registerOp(), for a sequence of ops by one client, all at the
+// same Version, each applying on top of the ones before it. The batch
+// is reconciled as a whole with the ops committed since, and committed
+// at consecutive revisions.
+func (pm *PadManager) registerBatch(ops []Op) []Op {
   pm.mu.Lock()
   defer pm.mu.Unlock()
 
-  opRet := opIn
-  if opIn.Version == pm.rev {
-    // No conflicts, apply it direcly
-    pm.applyCommittedOp(opIn)
+  id, base := ops[0].ID, ops[0].Version
+  for _, op := range ops {
+    assert(op.ID == id && op.Version == base, "registerBatch - batch")
+  }
+  assert(base <= pm.rev, "RegisterOp")
+  batch := append([]Op{}, ops...)
+  var cs *clientState
+  if base < pm.base {
+    for i := range batch {
+      batch[i].Type = NoOp
+    }
   } else {
-    assert(opIn.Version < pm.rev, "RegisterOp")
-    for v := opIn.Version; v < pm.rev; v++ {
-      opReconcile(&opRet, pm.history[v])
+    cs = pm.clientAt(id, base)
+    own := cs.own
+    for v := base; v < pm.rev; v++ {
+      h := pm.history[v]
+      if h.ID == id && len(own) > 0 {
+        // the client's own op, committed as the client applied it
+        own = own[1:]
+        continue
+      }
+      own, h = opTransformPast(own, h)
+      batch, _ = opTransformPast(batch, h)
+    }
+  }
+
+  for i := range batch {
+    batch[i].Version = pm.rev
+    batch[i] = pm.applyCommittedOp(batch[i])
+    if cs != nil {
+      own := ops[i]
+      if batch[i].Type == DeleteOp {
+        // what the client deleted, which it may not have said
+        own.Value = batch[i].Value
+      }
+      cs.own = append(cs.own, own)
     }
-    pm.applyCommittedOp(opRet)
   }
+  pm.maybeCompact()
 
-  return opRet
+  return batch
+}
+
+// PadManager::registerResume()
+// Like registerBatch(), for the ops a client queued on top of revision
+// ops[0].Version while disconnected, and returns those committed now.
+// The first of them may have been committed since through the lost
+// connection, and are skipped; any still to come through it are
+// leftovers from now on.
+func (pm *PadManager) registerResume(ops []Op) []Op {
+  id, since := ops[0].ID, ops[0].Version
+  pm.mu.Lock()
+  if s, ok := pm.resumed[id]; !ok || s < since {
+    pm.resumed[id] = since
+  }
+  pm.mu.Unlock()
+
+  skip := pm.ownSince(id, since)
+  if skip >= len(ops) {
+    return []Op{}
+  }
+  return pm.registerBatch(ops[skip:])
+}
+
+// PadManager::isLeftover()
+// Whether op was sent before its client last resumed, and so was
+// either committed by then or queued and resumed, since the client
+// sends ops at later revisions after resuming.
+func (pm *PadManager) isLeftover(op Op) bool {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  since, ok := pm.resumed[op.ID]
+  return ok && op.Version <= since
+}
+
+// PadManager::clientAt()
+// Returns the state of client id, brought forward to revision seen.
+func (pm *PadManager) clientAt(id int64, seen uint64) *clientState {
+  cs, ok := pm.clients[id]
+  if !ok || seen < cs.seen {
+    // new, or reloaded the pad and forgot what it had in flight
+    cs = &clientState{seen: seen}
+    pm.clients[id] = cs
+    return cs
+  }
+  for ; cs.seen < seen; cs.seen++ {
+    h := pm.history[cs.seen]
+    if h.ID == id && len(cs.own) > 0 {
+      cs.own = cs.own[1:]
+    } else {
+      cs.own, _ = opTransformPast(cs.own, h)
+    }
+  }
+  return cs
 }
 
 // PadManager::applyCommittedOp()
-// Applies a committed operation to update etherpad state.
-func (pm *PadManager) applyCommittedOp(op Op) {
+// Applies a committed operation to update etherpad state, and returns
+// it as applied: positions past the end or inside a surrogate pair
+// are moved to the end or the start of the pair, a delete's Value is
+// the code point it removed, and a delete past the end is a noop.
+func (pm *PadManager) applyCommittedOp(op Op) Op {
   assert(op.Version == pm.rev, "applyCommittedOp")
-  /*
+  n := uint64(len(pm.text))
   if op.Type == InsertOp {
-    if op.Position < 0 {
-      pm.text = op.Value[0:0] + pm.text
-    } else if op.Position >= uint64(len(pm.text)) {
-      pm.text += op.Value[0:0]
-    } else {
-      pm.text = pm.text[:op.Position] + op.Value[0:0] + pm.text[op.Position+1:]
+    if op.Position > n {
+      op.Position = n
     }
+    op.Position = pm.codePointStart(op.Position)
   } else if op.Type == DeleteOp {
-    if op.Position == 0 {
-      pm.text = pm.text[1:]
-    } else if op.Position == uint64(len(pm.text)) {
-      pm.text = pm.text[:len(pm.text)-1]
+    if op.Position < n {
+      pos := pm.codePointStart(op.Position)
+      end := pos + 1
+      if end < n && isPair(pm.text[pos], pm.text[end]) {
+        end++
+      }
+      op.Position = pos
+      op.Value = string(utf16.Decode(pm.text[pos:end]))
     } else {
-      pm.text = pm.text[:op.Position-1] + pm.text[op.Position+1:]
+      op.Type = NoOp
     }
   } else {
     // noop, do nothing
   }
-  */
+  pm.text = spliceOp(pm.text, op)
 
   _, ok := pm.history[pm.rev]
   assert(!ok, "applyCommittedOp - rev exists")
   pm.history[pm.rev] = op
   pm.rev++
 
-  return
+  return op
+}
+
+// spliceOp()
+// Returns text with the committed op applied, reusing text where it
+// can.
+func spliceOp(text []uint16, op Op) []uint16 {
+  if op.Type == InsertOp {
+    ins := utf16.Encode([]rune(op.Value))
+    out := make([]uint16, 0, len(text)+len(ins))
+    out = append(out, text[:op.Position]...)
+    out = append(out, ins...)
+    return append(out, text[op.Position:]...)
+  } else if op.Type == DeleteOp {
+    return append(text[:op.Position], text[op.Position+op.length():]...)
+  }
+  return text
+}
+
+// PadManager::maybeCompact()
+// Compacts the history in batches. Every replica does so at the same
+// revisions.
+func (pm *PadManager) maybeCompact() {
+  if pm.keep > 0 && pm.rev-pm.base >= uint64(2*pm.keep) {
+    pm.compact(pm.rev - uint64(pm.keep))
+  }
+}
+
+// PadManager::compact()
+// Forgets the history before revision base. Clients are brought
+// forward to base, and those with nothing in flight are forgotten
+// too; a client that comes back later starts afresh, which is the
+// same to it.
+func (pm *PadManager) compact(base uint64) {
+  for id, cs := range pm.clients {
+    if cs.seen < base {
+      cs = pm.clientAt(id, base)
+    }
+    if len(cs.own) == 0 {
+      delete(pm.clients, id)
+    }
+  }
+  for ; pm.base < base; pm.base++ {
+    pm.baseText = spliceOp(pm.baseText, pm.history[pm.base])
+    delete(pm.history, pm.base)
+  }
+}
+
+// PadManager::codePointStart()
+// Returns pos, or pos-1 if pos falls between the two halves of a
+// surrogate pair.
+func (pm *PadManager) codePointStart(pos uint64) uint64 {
+  if pos > 0 && pos < uint64(len(pm.text)) &&
+     isPair(pm.text[pos-1], pm.text[pos]) {
+    return pos - 1
+  }
+  return pos
+}
+
+func isPair(hi uint16, lo uint16) bool {
+  return utf16.DecodeRune(rune(hi), rune(lo)) != unicode.ReplacementChar
 }
 
 // opReconcile()
@@ -86,19 +273,34 @@ func (pm *PadManager) applyCommittedOp(op Op) {
 // function in a loop to iteratively merge op1 with all committed
 // operations to transform op1 into a committed operation.
 func opReconcile(op1 *Op, op2 Op) {
-  assert(op1.Version == op2.Version, "opReconcile - rev")
+  // of two inserts at one position, the committed one goes first
+  opTransform(op1, op2, true)
+}
+
+// opTransform()
+// Transforms op1 to apply after op2, where both apply to the same
+// revision. Where both insert at the same position, op2's text goes
+// first if op2First. Applying op2 and then the transformed op1 has
+// the same effect as applying op1 and then op2 transformed with
+// !op2First.
+func opTransform(op1 *Op, op2 Op, op2First bool) {
+  assert(op1.Version == op2.Version, "opTransform - rev")
   if op1.Type == InsertOp {
     if op2.Type == InsertOp {
       // insert vs. insert
-      if op2.Position <= op1.Position {
-        op1.Position++
+      if op2.Position < op1.Position ||
+         (op2.Position == op1.Position && op2First) {
+        op1.Position += op2.length()
       } else {
         // nothing to be done here
       }
     } else if op2.Type == DeleteOp {
-      // insert vs. delete
-      if op2.Position <= op1.Position {
-        op1.Position--
+      // insert vs. delete: inserting right where a character was
+      // deleted, or inside it, inserts there
+      if op2.Position+op2.length() <= op1.Position {
+        op1.Position -= op2.length()
+      } else if op2.Position < op1.Position {
+        op1.Position = op2.Position
       } else {
         // do nothing
       }
@@ -107,17 +309,19 @@ func opReconcile(op1 *Op, op2 Op) {
     }
   } else if op1.Type == DeleteOp {
     if op2.Type == InsertOp {
-      // delete vs. insert
-      if op2.Position < op1.Position {
-        op1.Position++
+      // delete vs. insert: a character inserted right where the
+      // deleted one was pushes it right
+      if op2.Position <= op1.Position {
+        op1.Position += op2.length()
       } else {
         // nothing to be done here
       }
     } else if op2.Type == DeleteOp {
-      // delete vs. delete, be extra careful here
-      if op2.Position < op1.Position {
-        op1.Position--
-      } else if op2.Position == op1.Position {
+      // delete vs. delete, be extra careful here: deleting any part
+      // of the same character deletes it only once
+      if op2.Position+op2.length() <= op1.Position {
+        op1.Position -= op2.length()
+      } else if op2.Position <= op1.Position {
         op1.Type = NoOp
       } else {
         // do nothing
@@ -132,28 +336,188 @@ func opReconcile(op1 *Op, op2 Op) {
   return
 }
 
-func (pm *PadManager) getLatestInfo() PadInfo {
+// opTransformPast()
+// Transforms the sequence ops and the committed op h, which apply to
+// the same revision, past each other. Where both insert at one
+// position, h goes first, as in opReconcile(). Versions are ignored.
+func opTransformPast(ops []Op, h Op) ([]Op, Op) {
+  out := make([]Op, len(ops))
+  for i, op := range ops {
+    op.Version, h.Version = 0, 0
+    out[i] = op
+    opTransform(&out[i], h, true)
+    opTransform(&h, op, false)
+  }
+  return out, h
+}
+
+// PadManager::roleOf()
+// Returns the role user holds on this pad. Until somebody claims the
+// pad, everybody may edit it.
+func (pm *PadManager) roleOf(user string) int {
   pm.mu.Lock()
   defer pm.mu.Unlock()
-  
+
+  if len(pm.acl) == 0 {
+    return RoleEditor
+  }
+  return pm.acl[user]
+}
+
+func (pm *PadManager) isClaimed() bool {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  return len(pm.acl) > 0
+}
+
+// PadManager::applyClaim()
+// Makes user the owner of this pad, unless somebody else claimed it
+// first. Like registerOp(), must be called in paxos-log order.
+func (pm *PadManager) applyClaim(user string) {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+
+  if len(pm.acl) == 0 {
+    pm.acl[user] = RoleOwner
+  }
+}
+
+// PadManager::applySetRole()
+// Grants role to user, or revokes all access if role is RoleNone.
+// Must be called in paxos-log order.
+func (pm *PadManager) applySetRole(user string, role int) {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+
+  if role == RoleNone {
+    delete(pm.acl, user)
+  } else {
+    pm.acl[user] = role
+  }
+}
+
+// PadManager::applyAlias()
+// Makes alias the read-only alias of this pad, unless one was minted
+// before. Returns whether alias was taken. Must be called in paxos-log
+// order.
+func (pm *PadManager) applyAlias(alias string) bool {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+
+  if pm.alias != "" {
+    return false
+  }
+  pm.alias = alias
+  return true
+}
+
+func (pm *PadManager) getAlias() string {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  return pm.alias
+}
+
+// PadManager::size()
+// Returns the length of the text in code units.
+func (pm *PadManager) size() int {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  return len(pm.text)
+}
+
+func (pm *PadManager) getText() string {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  return string(utf16.Decode(pm.text))
+}
+
+// PadManager::textAt()
+// Returns the text and the revision it is at.
+func (pm *PadManager) textAt() (string, uint64) {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  return string(utf16.Decode(pm.text)), pm.rev
+}
+
+func (pm *PadManager) revision() uint64 {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  return pm.rev
+}
+
+// PadManager::checkVersion()
+// Returns an error unless ops sent at revision v can be reconciled
+// with the ops committed since, i.e. v is reached and still kept.
+func (pm *PadManager) checkVersion(v uint64) error {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+  if v > pm.rev {
+    return protoErrorf(ErrUnknownRevision, "unknown revision")
+  }
+  if v < pm.base {
+    return protoErrorf(ErrCompacted, "revision %v is no longer kept; " +
+                       "reload the pad", v)
+  }
+  return nil
+}
+
+// PadManager::getInfoSince()
+// Returns the ops committed from revision since on. If those are no
+// longer all kept, returns the text at the oldest revision kept and
+// the ops after it instead. since must not be past the current
+// revision.
+func (pm *PadManager) getInfoSince(since uint64) PadInfo {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+
+  assert(since <= pm.rev, "getInfoSince")
   ret := PadInfo{}
   ret.PadId = pm.padId
   ret.Version = pm.rev
+  ret.Base = since
+  if since < pm.base {
+    ret.Base = pm.base
+    ret.Snapshot = true
+    ret.Text = string(utf16.Decode(pm.baseText))
+  }
   ret.Ops = make([]SOp, 0)
-  for i := uint64(0); i < pm.rev; i++ {
+  for i := ret.Base; i < pm.rev; i++ {
     ret.Ops = append(ret.Ops, toStringOp(pm.history[i]))
   }
 
   return ret
 }
 
-func NewPadManager(padId string) *PadManager {
+// PadManager::ownSince()
+// Returns how many ops of client id were committed from revision
+// since on.
+func (pm *PadManager) ownSince(id int64, since uint64) int {
+  pm.mu.Lock()
+  defer pm.mu.Unlock()
+
+  n := 0
+  for v := since; v < pm.rev; v++ {
+    if pm.history[v].ID == id {
+      n++
+    }
+  }
+  return n
+}
+
+// NewPadManager()
+// Makes an empty pad, which keeps at least keep revisions of history
+// for reconciling late ops and resuming clients; 0 keeps all of it.
+func NewPadManager(padId string, keep int) *PadManager {
   pm := PadManager{}
 
   pm.padId = padId
+  pm.keep = keep
   pm.rev = uint64(0)
-  pm.text = ""
+  pm.text = nil
   pm.history = make(map[uint64]Op)
+  pm.acl = make(map[string]int)
+  pm.clients = make(map[int64]*clientState)
+  pm.resumed = make(map[int64]uint64)
 
   return &pm
 }
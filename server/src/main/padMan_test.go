@@ -0,0 +1,583 @@
+package main
+
+import (
+  "fmt"
+  "math/rand"
+  "strings"
+  "testing"
+  "unicode/utf16"
+)
+
+// otCase is a generated transformation problem: two sequences of ops,
+// made concurrently against the same document.
+type otCase struct {
+  doc    string
+  a      []Op
+  b      []Op
+  aFirst bool // whether a's text goes first where both insert
+}
+
+func (c otCase) String() string {
+  var s []string
+  s = append(s, fmt.Sprintf("doc %q, aFirst %v", c.doc, c.aFirst))
+  for _, op := range c.a {
+    s = append(s, fmt.Sprintf("a: %v", opString(op)))
+  }
+  for _, op := range c.b {
+    s = append(s, fmt.Sprintf("b: %v", opString(op)))
+  }
+  return strings.Join(s, "\n  ")
+}
+
+func opString(op Op) string {
+  switch op.Type {
+  case InsertOp:
+    return fmt.Sprintf("v%v insert %q at %v", op.Version, op.Value, op.Position)
+  case DeleteOp:
+    return fmt.Sprintf("v%v delete %q at %v", op.Version, op.Value,
+                       op.Position)
+  }
+  return fmt.Sprintf("v%v noop", op.Version)
+}
+
+func units(s string) []uint16 {
+  return utf16.Encode([]rune(s))
+}
+
+func unitString(u []uint16) string {
+  return string(utf16.Decode(u))
+}
+
+// applyOp returns doc with op applied, or false if op does not fit doc:
+// it is out of range, splits a surrogate pair, or deletes something
+// other than its Value, if it has one.
+func applyOp(doc string, op Op) (string, bool) {
+  u := units(doc)
+  pos := int(op.Position)
+  if op.Type == NoOp {
+    return doc, true
+  }
+  if pos > len(u) || (pos > 0 && pos < len(u) && isPair(u[pos-1], u[pos])) {
+    return doc, false
+  }
+  switch op.Type {
+  case InsertOp:
+    return unitString(u[:pos]) + op.Value + unitString(u[pos:]), true
+  case DeleteOp:
+    end := pos + int(op.length())
+    if end > len(u) || (op.Value != "" && unitString(u[pos:end]) != op.Value) {
+      return doc, false
+    }
+    return unitString(u[:pos]) + unitString(u[end:]), true
+  }
+  return doc, true
+}
+
+func applyOps(doc string, ops []Op) (string, bool) {
+  ok := true
+  for _, op := range ops {
+    if doc, ok = applyOp(doc, op); !ok {
+      break
+    }
+  }
+  return doc, ok
+}
+
+// transformSeq transforms every op in ops to apply after op, and op to
+// apply after all of ops.
+func transformSeq(ops []Op, op Op, opsFirst bool) ([]Op, Op) {
+  out := make([]Op, len(ops))
+  for i, o := range ops {
+    out[i] = o
+    opTransform(&out[i], op, !opsFirst)
+    opTransform(&op, o, opsFirst)
+  }
+  return out, op
+}
+
+// converges applies a then the transformed b, and b then the
+// transformed a, to c.doc. It returns both results, which must match.
+func converges(c otCase) (string, string) {
+  a := c.a
+  var b []Op
+  for _, op := range c.b {
+    var bop Op
+    a, bop = transformSeq(a, op, c.aFirst)
+    b = append(b, bop)
+  }
+  ab, _ := applyOps(c.doc, c.a)
+  ab, _ = applyOps(ab, b)
+  ba, _ := applyOps(c.doc, c.b)
+  ba, _ = applyOps(ba, a)
+  return ab, ba
+}
+
+// valid reports whether every op of c fits the document it applies to.
+func (c otCase) valid() bool {
+  _, aok := applyOps(c.doc, c.a)
+  _, bok := applyOps(c.doc, c.b)
+  return aok && bok
+}
+
+func diverges(c otCase) bool {
+  ab, ba := converges(c)
+  return ab != ba
+}
+
+// randOps makes n ops against doc, inserting strings from alphabet.
+func randOps(rng *rand.Rand, doc string, n int, alphabet []string) []Op {
+  var ops []Op
+  for i := 0; i < n; i++ {
+    op := Op{Version: uint64(i), Type: InsertOp}
+    runes := []rune(doc)
+    k := rng.Intn(len(runes) + 1)
+    op.Position = uint64(len(units(string(runes[:k]))))
+    if k < len(runes) && rng.Intn(2) == 0 {
+      op.Type = DeleteOp
+      op.Value = string(runes[k])
+    } else {
+      op.Value = alphabet[rng.Intn(len(alphabet))]
+    }
+    doc, _ = applyOp(doc, op)
+    ops = append(ops, op)
+  }
+  return ops
+}
+
+// Documents mix characters of one and two code units, and combining
+// marks, which are code points of their own.
+var (
+  docChars = []rune{'x', 'y', '\u0301', '😀'}
+  aValues  = []string{"A", "B", "🅰", "Ae\u0301"}
+  bValues  = []string{"a", "b", "🙂", "\u0301"}
+)
+
+func randCase(rng *rand.Rand, maxDoc int, maxOps int) otCase {
+  c := otCase{}
+  doc := make([]rune, rng.Intn(maxDoc+1))
+  for i := range doc {
+    doc[i] = docChars[rng.Intn(len(docChars))]
+  }
+  c.doc = string(doc)
+  c.a = randOps(rng, c.doc, 1+rng.Intn(maxOps), aValues)
+  c.b = randOps(rng, c.doc, 1+rng.Intn(maxOps), bValues)
+  c.aFirst = rng.Intn(2) == 0
+  return c
+}
+
+func renumber(ops []Op) []Op {
+  out := make([]Op, len(ops))
+  for i, op := range ops {
+    op.Version = uint64(i)
+    out[i] = op
+  }
+  return out
+}
+
+func without(ops []Op, i int) []Op {
+  out := append([]Op{}, ops[:i]...)
+  return renumber(append(out, ops[i+1:]...))
+}
+
+// shrinkCandidates returns cases one step simpler than c.
+func shrinkCandidates(c otCase) []otCase {
+  var cs []otCase
+  for i := range c.a {
+    if len(c.a) > 1 {
+      d := c
+      d.a = without(c.a, i)
+      cs = append(cs, d)
+    }
+  }
+  for i := range c.b {
+    if len(c.b) > 1 {
+      d := c
+      d.b = without(c.b, i)
+      cs = append(cs, d)
+    }
+  }
+  doc := []rune(c.doc)
+  for i := range doc {
+    d := c
+    d.doc = string(doc[:i]) + string(doc[i+1:])
+    cs = append(cs, d)
+  }
+  for _, seq := range []*[]Op{&c.a, &c.b} {
+    for i, op := range *seq {
+      if op.Position > 0 {
+        d := c
+        ops := append([]Op{}, (*seq)...)
+        ops[i].Position--
+        if seq == &c.a {
+          d.a = ops
+        } else {
+          d.b = ops
+        }
+        cs = append(cs, d)
+      }
+    }
+  }
+  return cs
+}
+
+// shrink returns the simplest case it can reach from c for which fails
+// still holds.
+func shrink(c otCase, fails func(otCase) bool) otCase {
+  for {
+    progress := false
+    for _, d := range shrinkCandidates(c) {
+      if d.valid() && fails(d) {
+        c = d
+        progress = true
+        break
+      }
+    }
+    if !progress {
+      return c
+    }
+  }
+}
+
+// checkConvergence runs n random cases, and fails with the smallest
+// counterexample found.
+func checkConvergence(t *testing.T, seed int64, n int, maxDoc int,
+                      maxOps int) {
+  rng := rand.New(rand.NewSource(seed))
+  for i := 0; i < n; i++ {
+    c := randCase(rng, maxDoc, maxOps)
+    if diverges(c) {
+      m := shrink(c, diverges)
+      ab, ba := converges(m)
+      t.Fatalf("case %v of seed %v diverges: %q vs. %q, minimized to\n  %v",
+               i, seed, ab, ba, m)
+    }
+  }
+}
+
+func TestTransformPairs(t *testing.T) {
+  fmt.Printf("Test: Transformed op pairs converge ...\n")
+  checkConvergence(t, 1, 20000, 6, 1)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTransformSequences(t *testing.T) {
+  fmt.Printf("Test: Transformed op sequences converge ...\n")
+  checkConvergence(t, 2, 20000, 8, 5)
+  fmt.Printf("  ... Passed\n")
+}
+
+// Each branch of opTransform, against the text it should produce.
+func TestTransformCases(t *testing.T) {
+  fmt.Printf("Test: Transform rules ...\n")
+
+  ins := func(pos uint64, v string) Op {
+    return Op{Type: InsertOp, Position: pos, Value: v}
+  }
+  del := func(pos uint64) Op {
+    return Op{Type: DeleteOp, Position: pos}
+  }
+  delv := func(pos uint64, v string) Op {
+    return Op{Type: DeleteOp, Position: pos, Value: v}
+  }
+  cases := []struct {
+    doc    string
+    a      Op
+    b      Op
+    aFirst bool
+    want   string
+  }{
+    {"xy", ins(1, "A"), ins(1, "b"), true, "xAby"},
+    {"xy", ins(1, "A"), ins(1, "b"), false, "xbAy"},
+    {"xy", ins(0, "A"), ins(2, "b"), true, "Axyb"},
+    {"xyz", ins(1, "A"), del(1), true, "xAz"},
+    {"xyz", ins(2, "A"), del(1), true, "xAz"},
+    {"xyz", ins(1, "A"), del(2), true, "xAy"},
+    {"xyz", del(1), ins(1, "b"), true, "xbz"},
+    {"xyz", del(1), del(1), true, "xz"},
+    {"xyz", del(0), del(2), true, "y"},
+    // characters of two code units
+    {"x😀y", ins(1, "🅰"), ins(1, "b"), true, "x🅰b😀y"},
+    {"x😀y", ins(3, "A"), delv(1, "😀"), true, "xAy"},
+    {"x😀y", delv(1, "😀"), ins(3, "b"), true, "xby"},
+    {"x😀y", delv(3, "y"), delv(1, "😀"), true, "x"},
+    {"x😀y", delv(1, "😀"), delv(1, "😀"), true, "xy"},
+    // a combining mark is a character of its own
+    {"e\u0301x", delv(1, "\u0301"), ins(1, "b"), true, "ebx"},
+    {"e\u0301x", delv(0, "e"), delv(1, "\u0301"), true, "x"},
+  }
+  for _, tc := range cases {
+    c := otCase{tc.doc, []Op{tc.a}, []Op{tc.b}, tc.aFirst}
+    ab, ba := converges(c)
+    if ab != tc.want || ba != tc.want {
+      t.Fatalf("%v\n  gave %q and %q, want %q", c, ab, ba, tc.want)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// The shrinker itself, on a made-up failure: an insert by a at
+// position 2 or later.
+func TestShrink(t *testing.T) {
+  fmt.Printf("Test: Failing cases are minimized ...\n")
+
+  fails := func(c otCase) bool {
+    for _, op := range c.a {
+      if op.Type == InsertOp && op.Position >= 2 {
+        return true
+      }
+    }
+    return false
+  }
+  rng := rand.New(rand.NewSource(3))
+  nshrunk := 0
+  for i := 0; i < 1000; i++ {
+    c := randCase(rng, 8, 5)
+    if !fails(c) {
+      continue
+    }
+    m := shrink(c, fails)
+    if !m.valid() || !fails(m) {
+      t.Fatalf("shrunk to a case that does not fail:\n  %v", m)
+    }
+    if len(m.doc) > len(c.doc) || len(m.a) > len(c.a) || len(m.b) > len(c.b) {
+      t.Fatalf("shrinking grew\n  %v\nto\n  %v", c, m)
+    }
+    for _, d := range shrinkCandidates(m) {
+      if d.valid() && fails(d) {
+        t.Fatalf("not minimal:\n  %v\nstill fails as\n  %v", m, d)
+      }
+    }
+    nshrunk++
+  }
+  if nshrunk == 0 {
+    t.Fatalf("no failing cases generated")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// A client that types "ab" before seeing "a" committed, while another
+// client inserts "x" at the front.
+func TestRegisterOpInFlight(t *testing.T) {
+  fmt.Printf("Test: Ops built on ops in flight ...\n")
+
+  pm := NewPadManager("p", 0)
+  pm.registerOp(Op{ID: 2, Version: 0, Type: InsertOp, Position: 0, Value: "x"})
+  pm.registerOp(Op{ID: 1, Version: 0, Type: InsertOp, Position: 0, Value: "a"})
+  cop := pm.registerOp(Op{ID: 1, Version: 0, Type: InsertOp, Position: 1,
+                          Value: "b"})
+  if cop.Position != 2 || pm.getText() != "xab" {
+    t.Fatalf("committed %+v, text %q; want position 2, \"xab\"",
+             cop, pm.getText())
+  }
+
+  // once the client has seen its ops, it no longer builds on them
+  pm.registerOp(Op{ID: 2, Version: 3, Type: DeleteOp, Position: 0, Value: "x"})
+  cop = pm.registerOp(Op{ID: 1, Version: 3, Type: DeleteOp, Position: 2,
+                         Value: "b"})
+  if cop.Position != 1 || pm.getText() != "a" {
+    t.Fatalf("committed %+v, text %q; want position 1, \"a\"",
+             cop, pm.getText())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// Positions count UTF-16 code units, as the browser does.
+func TestUnicodePositions(t *testing.T) {
+  fmt.Printf("Test: Positions in UTF-16 code units ...\n")
+
+  pm := NewPadManager("p", 0)
+  op := func(v uint64, typ int, pos uint64, val string) Op {
+    return pm.registerOp(Op{ID: 1, Version: v, Type: typ, Position: pos,
+                            Value: val})
+  }
+  check := func(cop Op, typ int, pos uint64, val string, text string) {
+    if cop.Type != typ || cop.Position != pos || cop.Value != val ||
+       pm.getText() != text {
+      t.Fatalf("committed %v, text %q; want %v, %q", opString(cop),
+               pm.getText(), opString(Op{Version: cop.Version, Type: typ,
+               Position: pos, Value: val}), text)
+    }
+  }
+
+  check(op(0, InsertOp, 0, "😀"), InsertOp, 0, "😀", "😀")
+  check(op(1, InsertOp, 2, "x"), InsertOp, 2, "x", "😀x")
+  if pm.size() != 3 {
+    t.Fatalf("size %v, want 3", pm.size())
+  }
+
+  // inside a surrogate pair means before it
+  check(op(2, InsertOp, 1, "y"), InsertOp, 0, "y", "y😀x")
+  // a delete removes a whole pair, whichever half it names, and says so
+  check(op(3, DeleteOp, 2, ""), DeleteOp, 1, "😀", "yx")
+
+  // combining marks are deleted on their own
+  check(op(4, InsertOp, 1, "e\u0301"), InsertOp, 1, "e\u0301", "ye\u0301x")
+  check(op(5, DeleteOp, 2, "x"), DeleteOp, 2, "\u0301", "yex")
+
+  // past the end, inserts append and deletes do nothing
+  check(op(6, InsertOp, 9, "🙂"), InsertOp, 3, "🙂", "yex🙂")
+  check(op(7, DeleteOp, 5, ""), NoOp, 5, "", "yex🙂")
+  if s := toStringOp(pm.history[7]); s.Type != "NoOp" {
+    t.Fatalf("noop sent to clients as %q", s.Type)
+  }
+
+  // a committed delete of two code units moves later ops by two
+  pm.registerOp(Op{ID: 2, Version: 8, Type: DeleteOp, Position: 3})
+  check(op(8, InsertOp, 5, "z"), InsertOp, 3, "z", "yexz")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// A delete removes one code point, whatever Value the client gave it,
+// and is transformed as such.
+func TestMultiUnitDelete(t *testing.T) {
+  fmt.Printf("Test: Deletes with several code units in Value ...\n")
+
+  pm := NewPadManager("p", 0)
+  pm.registerOp(Op{ID: 9, Version: 0, Type: InsertOp, Position: 0,
+                   Value: "abcd"})
+  pm.registerOp(Op{ID: 2, Version: 1, Type: InsertOp, Position: 3,
+                   Value: "X"})
+  // a selection of "bc" deleted concurrently, as a browser does
+  cops := pm.registerBatch([]Op{
+    {ID: 1, Version: 1, Type: DeleteOp, Position: 1, Value: "bc"},
+    {ID: 1, Version: 1, Type: DeleteOp, Position: 1, Value: "c"}})
+  if pm.getText() != "aXd" || cops[0].Value != "b" || cops[1].Value != "c" {
+    t.Fatalf("committed %v, %v; text %q, want \"aXd\"", opString(cops[0]),
+             opString(cops[1]), pm.getText())
+  }
+
+  cop := pm.registerOp(Op{ID: 3, Version: 4, Type: DeleteOp, Position: 0,
+                          Value: "aX😀"})
+  if pm.getText() != "Xd" || cop.Value != "a" {
+    t.Fatalf("committed %v, text %q; want \"Xd\"", opString(cop),
+             pm.getText())
+  }
+  if n := (Op{Type: DeleteOp, Value: "😀a"}).length(); n != 2 {
+    t.Fatalf("delete of an emoji has length %v, want 2", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// History is compacted in batches, and a client resuming from before
+// what is kept gets a snapshot.
+func TestCompaction(t *testing.T) {
+  fmt.Printf("Test: History compaction ...\n")
+
+  pm := NewPadManager("p", 2)
+  for i := 0; i < 3; i++ {
+    pm.registerOp(Op{ID: 2, Version: uint64(i), Type: InsertOp,
+                     Position: uint64(i), Value: "x"})
+  }
+  // client 1 has "a" in flight when history is compacted
+  pm.registerOp(Op{ID: 1, Version: 3, Type: InsertOp, Position: 0,
+                   Value: "a"})
+  if pm.base != 2 || len(pm.history) != 2 || unitString(pm.baseText) != "xx" {
+    t.Fatalf("base %v, %v ops kept, base text %q; want 2, 2, \"xx\"",
+             pm.base, len(pm.history), unitString(pm.baseText))
+  }
+  if _, ok := pm.clients[1]; !ok {
+    t.Fatalf("client with an op in flight forgotten")
+  }
+
+  // and still builds on it afterwards
+  cop := pm.registerOp(Op{ID: 1, Version: 3, Type: InsertOp, Position: 1,
+                          Value: "b"})
+  if cop.Position != 1 || pm.getText() != "abxxx" {
+    t.Fatalf("committed %v, text %q; want position 1, \"abxxx\"",
+             opString(cop), pm.getText())
+  }
+
+  // an op from before the history kept cannot be reconciled
+  cop = pm.registerOp(Op{ID: 3, Version: 1, Type: InsertOp, Position: 1,
+                         Value: "c"})
+  if cop.Type != NoOp || pm.getText() != "abxxx" {
+    t.Fatalf("committed %v, text %q; want a noop", opString(cop),
+             pm.getText())
+  }
+
+  resume := func(since uint64, snapshot bool, base uint64, nops int) {
+    pi := pm.getInfoSince(since)
+    if pi.Snapshot != snapshot || pi.Base != base || len(pi.Ops) != nops ||
+       pi.Version != pm.rev {
+      t.Fatalf("since %v: got %+v", since, pi)
+    }
+    if !snapshot {
+      return
+    }
+    text := pi.Text
+    for _, sop := range pi.Ops {
+      op := Op{Type: NoOp, Position: sop.Position, Value: sop.Value}
+      if sop.Type == "Insert" {
+        op.Type = InsertOp
+      } else if sop.Type == "Delete" {
+        op.Type = DeleteOp
+      }
+      text, _ = applyOp(text, op)
+    }
+    if text != pm.getText() {
+      t.Fatalf("snapshot since %v yields %q, want %q", since, text,
+               pm.getText())
+    }
+  }
+  resume(6, false, 6, 0)
+  resume(4, false, 4, 2)
+  resume(1, true, 4, 2)
+  resume(0, true, 4, 2)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// A batch made offline against an old revision ends up as if its ops
+// had been transformed one at a time past the ops committed since.
+func TestRegisterBatch(t *testing.T) {
+  fmt.Printf("Test: Batches are transformed as a sequence ...\n")
+
+  rng := rand.New(rand.NewSource(4))
+  for i := 0; i < 2000; i++ {
+    c := randCase(rng, 8, 6)
+    c.aFirst = true // committed ops go first
+    pm := NewPadManager("p", 0)
+    pm.registerOp(Op{ID: 3, Type: InsertOp, Value: c.doc})
+    for _, op := range c.a {
+      op.ID = 1
+      op.Version++
+      pm.registerOp(op)
+    }
+    batch := make([]Op, len(c.b))
+    for j, op := range c.b {
+      op.ID = 2
+      op.Version = 1
+      batch[j] = op
+    }
+    cops := pm.registerBatch(batch)
+    want, _ := converges(c)
+    if pm.getText() != want || len(cops) != len(batch) {
+      t.Fatalf("case %v: text %q, want %q\n  %v", i, pm.getText(), want, c)
+    }
+    for j, cop := range cops {
+      if cop.Version != uint64(1+len(c.a)+j) {
+        t.Fatalf("case %v: op %v committed at %v", i, j, cop.Version)
+      }
+    }
+  }
+
+  // a batch older than the history kept is dropped as a whole
+  pm := NewPadManager("p", 1)
+  pm.registerOp(Op{ID: 1, Type: InsertOp, Value: "x"})
+  pm.registerOp(Op{ID: 1, Version: 1, Type: InsertOp, Value: "y"})
+  cops := pm.registerBatch([]Op{
+    {ID: 2, Type: InsertOp, Value: "a"},
+    {ID: 2, Type: InsertOp, Position: 1, Value: "b"},
+  })
+  if cops[0].Type != NoOp || cops[1].Type != NoOp || pm.getText() != "yx" {
+    t.Fatalf("stale batch committed as %v, %v", opString(cops[0]),
+             opString(cops[1]))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
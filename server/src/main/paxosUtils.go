@@ -17,26 +17,52 @@ type SOp struct {
   Value    string
 }
 
+// Kinds of paxos log entries
+const (
+  ClientOpEntry = iota // ClientOp is an edit to PadId
+  ClaimPadEntry        // User claims ownership of PadId
+  SetRoleEntry         // User is granted Role on PadId
+  MintAliasEntry       // Alias becomes the read-only alias of PadId
+  ResumeEntry          // Batch is the edits to PadId a client queued
+                       // on top of revision Batch[0].Version
+  ClientBatchEntry     // Batch is a sequence of edits to PadId
+  DeletePadEntry       // User deletes PadId, which starts over empty
+)
+
 type PxLogEntry struct {
   EntryId  int64
+  Kind     int
   PadId    string
   ClientOp Op
+  Batch    []Op
+  User     string
+  Role     int
+  Alias    string
 }
 
-var const_noop PxLogEntry = PxLogEntry{int64(0), "", Op{}}
+var const_noop PxLogEntry = PxLogEntry{EntryId: int64(0)}
 
 // EPServer::startAndWait():
 // Start a paxos agreement at instance number seq, and wait until
 // consensus is reached. Returns the decided log entry at that seq.
-// This function is only to be called by paxosAppendLog() and
-// paxosLogConsolidate().
+// This function is only to be called by paxosAppendToLog() and
+// paxosLogConsolidate_explicit().
 func (es *EPServer) startAndWait(seq int, le PxLogEntry) PxLogEntry {
-  to := 10 * time.Millisecond
+  t0 := time.Now()
   es.px.Start(seq, le)
+  v := es.awaitDecided(seq)
+  es.metrics.observeDecide(time.Since(t0))
+  return v
+}
+
+// EPServer::awaitDecided():
+// Waits until instance seq is decided, by whichever proposer drives it,
+// and returns the decided log entry.
+func (es *EPServer) awaitDecided(seq int) PxLogEntry {
+  to := 10 * time.Millisecond
   for {
     status, v := es.px.Status(seq)
     if status == paxos.Decided {
-      // Always return with mutex held
       return v.(PxLogEntry)
     }
     time.Sleep(to)
@@ -48,14 +74,18 @@ func (es *EPServer) startAndWait(seq int, le PxLogEntry) PxLogEntry {
 }
 
 // EPServer::paxosAppendToLog():
-// Appends LogEntry to the end of the paxos log known to this server,
-// and returns the position in log of the appended entry
+// Appends LogEntry to the paxos log, and returns the position in log
+// of the appended entry. Does not require es.mu, so that several
+// entries can be appended concurrently.
 //
-// It can be shown by induction that this eager appending technique
-// leaves no holes in the log.
+// Every instance reserved by reserveSeq() is driven to a decision by
+// the caller that reserved it, whether or not its own entry wins, so
+// local proposals leave no holes in the log: paxosLogConsolidate_explicit()
+// waits for them instead of filling them, and only fills holes left by
+// other replicas.
 func (es *EPServer) paxosAppendToLog(le PxLogEntry) int {
-  seq := es.px.Max() + 1
   for {
+    seq := es.reserveSeq()
     var temp PxLogEntry
     status, v := es.px.Status(seq)
     if status != paxos.Decided {
@@ -63,28 +93,74 @@ func (es *EPServer) paxosAppendToLog(le PxLogEntry) int {
     } else {
       temp = v.(PxLogEntry)
     }
+    es.releaseSeq(seq)
     if temp.EntryId == le.EntryId {
       // succeeds!
       return seq
     }
-    seq++
   }
 }
 
-// EPServer::paxosLogConsolidate():
-// Fill up potential holes in unapplied log (after commitPoint). Just
-// to be conservative.
-func (es *EPServer) paxosLogConsolidate() {
-  es.paxosLogConsolidate_explicit(es.px.Max())
+// EPServer::reserveSeq():
+// Returns an instance that no local proposal has used yet, past every
+// instance this replica knows of.
+func (es *EPServer) reserveSeq() int {
+  es.seqMu.Lock()
+  defer es.seqMu.Unlock()
+  seq := es.px.MaxKnown() + 1
+  if seq < es.nextSeq {
+    seq = es.nextSeq
+  }
+  es.nextSeq = seq + 1
+  es.inflight[seq] = true
+  return seq
+}
+
+// EPServer::isInflight():
+// Whether a local proposal has reserved seq and not yet seen it decided.
+func (es *EPServer) isInflight(seq int) bool {
+  es.seqMu.Lock()
+  defer es.seqMu.Unlock()
+  return es.inflight[seq]
+}
+
+func (es *EPServer) releaseSeq(seq int) {
+  es.seqMu.Lock()
+  delete(es.inflight, seq)
+  es.seqMu.Unlock()
 }
 
+// EPServer::paxosDone():
+// Lets paxos forget instances up to and including seq, except those a
+// local proposal is still waiting on: once forgotten, it could not
+// tell whether its entry won.
+func (es *EPServer) paxosDone(seq int) {
+  es.seqMu.Lock()
+  defer es.seqMu.Unlock()
+  for s := range es.inflight {
+    if s <= seq {
+      seq = s - 1
+    }
+  }
+  es.px.Done(seq)
+}
+
+// EPServer::paxosLogConsolidate_explicit():
+// Fill up potential holes in unapplied log (after commitPoint) up to
+// and including upto. An instance a local proposal has reserved is
+// left to it, since filling it would only make that proposal retry at
+// a later instance. Any other hole is usually an instance another
+// replica is still deciding, which then either finishes first or
+// loses it to the noop and retries elsewhere.
 func (es *EPServer) paxosLogConsolidate_explicit(upto int) {
   for i := es.commitPoint; i <= upto; i++ {
     status, _ := es.px.Status(i)
     if status == paxos.Decided {
       continue
+    } else if es.isInflight(i) {
+      es.awaitDecided(i)
     } else {
-      // insert a noop (this should never be executed)
+      // insert a noop
       es.startAndWait(i, const_noop)
     }
   }
@@ -99,40 +175,134 @@ func (es *EPServer) applyLog(ceiling int) {
     status, le := es.px.Status(es.commitPoint)
     assert(status == paxos.Decided, "applyLog")
 
-    es.applyEntry(le.(PxLogEntry))
+    es.applyEntry(es.commitPoint, le.(PxLogEntry))
     es.commitPoint++
   }
-  es.px.Done(ceiling)
+  es.metrics.setCommitPoint(es.commitPoint)
+  es.paxosDone(ceiling)
+}
+
+// EPServer::getCommitPoint():
+// Returns es.commitPoint as of the last applyLog(), without taking
+// es.mu.
+func (es *EPServer) getCommitPoint() int {
+  return es.metrics.getCommitPoint()
 }
 
 // EPServer::applyEntry():
 // Update etherpad state and broadcast the committed operation to all
 // sockets connected to this etherpad. Note that different clients
 // could be connected to different paxos peers
-func (es *EPServer) applyEntry(le PxLogEntry) {
+func (es *EPServer) applyEntry(seq int, le PxLogEntry) {
   if le.EntryId == int64(0) {
     return
   }
+  lg := es.log.With("pad", le.PadId, "seq", seq, "op", le.EntryId)
 
   pm, ok := es.pads[le.PadId]
   if !ok {
-    pm = NewPadManager(le.PadId)
+    pm = NewPadManager(le.PadId, es.history)
     es.pads[le.PadId] = pm
+    es.metrics.setPadsLoaded(len(es.pads))
+  }
+
+  switch le.Kind {
+  case ClaimPadEntry:
+    pm.applyClaim(le.User)
+    lg.Info("pad claimed", "user", le.User)
+    return
+  case SetRoleEntry:
+    pm.applySetRole(le.User, le.Role)
+    lg.Info("role set", "user", le.User, "role", roleName(le.Role))
+    return
+  case MintAliasEntry:
+    if pm.applyAlias(le.Alias) {
+      es.aliases[le.Alias] = le.PadId
+      lg.Info("alias minted")
+    }
+    return
+  case DeletePadEntry:
+    if alias := pm.getAlias(); alias != "" {
+      delete(es.aliases, alias)
+    }
+    delete(es.pads, le.PadId)
+    es.metrics.setPadsLoaded(len(es.pads))
+    es.metrics.padDeleted(le.PadId)
+    msgJSON, err := json.Marshal(PadDeletedMsg{})
+    assert(err == nil, "applyEntry - delete")
+    es.bcast.Broadcast(le.PadId, "pad deleted", string(msgJSON))
+    lg.Info("pad deleted", "user", le.User)
+    return
+  }
+
+  ops := le.Batch
+  if le.Kind == ClientOpEntry {
+    ops = []Op{le.ClientOp}
   }
-  cop := pm.registerOp(le.ClientOp)
-  ncop := toStringOp(cop)
-  opJSON, err := json.Marshal(ncop)
-  assert(err == nil, "panic 2")
-  //log.Printf("broadcast %v\n", string(opJSON[:]))
-  es.sio.BroadcastTo(le.PadId, "op", string(opJSON[:]))
+  if ops[0].Version > pm.revision() {
+    // the pad was deleted after the ops were checked, and they apply
+    // to none of its revisions
+    es.dropEntry(le, ops)
+    lg.Info("ops of a deleted pad dropped", "client", ops[0].ID)
+    return
+  }
+  if le.Kind != ResumeEntry && pm.isLeftover(ops[0]) {
+    es.dropEntry(le, ops)
+    lg.Info("ops sent before resuming dropped", "client", ops[0].ID)
+    return
+  }
+
+  var cops []Op
+  switch le.Kind {
+  case ClientBatchEntry:
+    cops = pm.registerBatch(le.Batch)
+  case ResumeEntry:
+    cops = pm.registerResume(le.Batch)
+  default:
+    cops = []Op{pm.registerOp(le.ClientOp)}
+  }
+  if _, ok := es.results[le.EntryId]; ok {
+    es.results[le.EntryId] = cops
+  }
+  for _, cop := range cops {
+    es.metrics.opApplied(le.PadId)
+    lg.Debug("applied", "client", cop.ID, "rev", cop.Version)
+    ncop := toStringOp(cop)
+    opJSON, err := json.Marshal(ncop)
+    assert(err == nil, "panic 2")
+    es.bcast.Broadcast(le.PadId, "op", string(opJSON[:]))
+  }
+  lg.Debug("broadcast")
+}
+
+// EPServer::dropEntry():
+// Reports ops, those of le, to its proposer as committed as NoOps,
+// without committing anything.
+func (es *EPServer) dropEntry(le PxLogEntry, ops []Op) {
+  if _, ok := es.results[le.EntryId]; !ok {
+    return
+  }
+  cops := make([]Op, len(ops))
+  for i, op := range ops {
+    cops[i] = op
+    cops[i].Type = NoOp
+  }
+  es.results[le.EntryId] = cops
 }
 
+// toStringOp()
+// Converts a committed op for clients. Its Position counts UTF-16 code
+// units like a JavaScript string index, and a delete's Value holds the
+// one or two code units it removed. An op that was reconciled away is
+// sent as "NoOp", so clients only advance their version.
 func toStringOp(opIn Op) SOp {
   ret := SOp{opIn.ID, opIn.Version, "", opIn.Position, opIn.Value}
   if opIn.Type == InsertOp {
     ret.Type = "Insert"
-  } else {
+  } else if opIn.Type == DeleteOp {
     ret.Type = "Delete"
+  } else {
+    ret.Type = "NoOp"
   }
   return ret
 }
@@ -0,0 +1,321 @@
+package main
+
+//
+// The wire protocol between clients and a replica.
+//
+// A client may start with a "hello" message listing the protocol
+// versions it speaks. The replica answers with the version chosen and
+// the capabilities it offers. Clients that never say hello, like old
+// browsers, speak ProtoLegacy.
+//
+// Under ProtoLegacy, ops have all fields in string format, errors are
+// plain strings and ops are not acknowledged. Under ProtoTyped, every
+// message argument is a JSON object of one of the types below, decoded
+// strictly: unknown fields, unknown op types and malformed numbers are
+// rejected with an ErrorMsg rather than guessed at.
+//
+// client                          replica
+//   hello      HelloMsg     ->
+//              HelloReply   <-    hello
+//   open pad   OpenPadMsg   ->
+//              PadInfo      <-    init_comt_op
+//   op         OpMsg        ->
+//              AckMsg       <-    ack
+//              SOp          <-    op (every committed op, to all)
+//   op batch   BatchMsg     ->
+//              AckMsg       <-    ack
+//   set role   RoleMsg      ->
+//   share link ShareLinkMsg ->
+//              ShareLinkMsg <-    share link
+//              ErrorMsg     <-    error (in answer to any of the above)
+//              PadDeletedMsg <-   pad deleted (to all)
+//
+
+import (
+  "encoding/json"
+  "fmt"
+  "strings"
+)
+
+// Protocol versions
+const (
+  ProtoLegacy = 1
+  ProtoTyped  = 2
+  ProtoLatest = ProtoTyped
+)
+
+// What this replica offers under ProtoTyped.
+var Capabilities = []string{
+  "ack",    // ops and batches are acknowledged once committed
+  "batch",  // "op batch" messages
+  "resume", // "open pad" with Since and Pending
+  "utf16",  // positions count UTF-16 code units
+}
+
+// Error codes
+const (
+  ErrInvalid         = "invalid_request"    // malformed message
+  ErrUnknownOpType   = "unknown_op_type"
+  ErrUnsupported     = "unsupported_version"
+  ErrUnauthorized    = "unauthorized"       // authentication failed
+  ErrAccessDenied    = "access_denied"
+  ErrReadOnly        = "read_only"
+  ErrNotOpen         = "not_open"           // no pad opened yet
+  ErrAlreadyOpen     = "already_open"
+  ErrUnknownLink     = "unknown_share_link"
+  ErrUnknownRevision = "unknown_revision"   // revision not reached yet
+  ErrCompacted       = "revision_compacted" // revision no longer kept
+  ErrLimit           = "limit_exceeded"
+  ErrAuthDisabled    = "auth_disabled"
+  ErrPadDeleted      = "pad_deleted"
+)
+
+type HelloMsg struct {
+  Versions     []int    // protocol versions the client speaks
+  Capabilities []string // capabilities the client wants; all if empty
+}
+
+type HelloReply struct {
+  Version      int
+  Capabilities []string
+}
+
+type OpenPadMsg struct {
+  PadId   string
+  Since   uint64 // revision the client has seen up to, when resuming
+  Pending []SOp  // ops queued on top of Since, when resuming
+}
+
+type OpMsg struct {
+  Ref uint64 // chosen by the client, echoed in the AckMsg or ErrorMsg
+  Op  SOp
+}
+
+type BatchMsg struct {
+  Ref uint64
+  Ops []SOp
+}
+
+// AckMsg tells a client that the ops of its message Ref were
+// committed, in the form they were committed in. An op that was
+// reconciled away is committed as "NoOp".
+type AckMsg struct {
+  Ref uint64
+  Ops []SOp
+}
+
+type RoleMsg struct {
+  User string
+  Role string // none, viewer, editor or owner
+}
+
+type ShareLinkMsg struct {
+  Alias string // empty in requests
+}
+
+// PadDeletedMsg tells the clients of a pad that the pad they opened
+// was deleted. It names no pad: viewers that opened it through a
+// read-only alias must not learn its editable id. The pad starts over
+// empty, at revision 0, the next time it is opened.
+type PadDeletedMsg struct {
+}
+
+type ErrorMsg struct {
+  Code    string
+  Message string
+  Ref     uint64 // of the message in error, if it had one
+}
+
+// ProtoError is an error that clients are told about with its code.
+type ProtoError struct {
+  Code    string
+  Message string
+}
+
+func (e *ProtoError) Error() string {
+  return e.Message
+}
+
+func protoErrorf(code string, format string, args ...interface{}) error {
+  return &ProtoError{code, fmt.Sprintf(format, args...)}
+}
+
+// errorCode()
+// Returns the code of err if it is a ProtoError, or code otherwise.
+func errorCode(err error, code string) string {
+  if pe, ok := err.(*ProtoError); ok {
+    return pe.Code
+  }
+  return code
+}
+
+// negotiate()
+// Picks the newest version both sides speak, and the capabilities both
+// want.
+func negotiate(hello HelloMsg) (HelloReply, error) {
+  ret := HelloReply{}
+  for _, v := range hello.Versions {
+    if v >= ProtoLegacy && v <= ProtoLatest && v > ret.Version {
+      ret.Version = v
+    }
+  }
+  if ret.Version == 0 {
+    return ret, protoErrorf(ErrUnsupported,
+                            "no common protocol version; this replica " +
+                            "speaks %v to %v", ProtoLegacy, ProtoLatest)
+  }
+  ret.Capabilities = []string{}
+  if ret.Version < ProtoTyped {
+    return ret, nil
+  }
+  for _, c := range Capabilities {
+    if len(hello.Capabilities) == 0 || hasString(hello.Capabilities, c) {
+      ret.Capabilities = append(ret.Capabilities, c)
+    }
+  }
+  return ret, nil
+}
+
+func hasString(list []string, s string) bool {
+  for _, e := range list {
+    if e == s {
+      return true
+    }
+  }
+  return false
+}
+
+// decodeStrict()
+// Decodes the JSON object data into v, rejecting fields v does not
+// have and anything after the object.
+func decodeStrict(data string, v interface{}) error {
+  dec := json.NewDecoder(strings.NewReader(data))
+  dec.DisallowUnknownFields()
+  if err := dec.Decode(v); err != nil {
+    return protoErrorf(ErrInvalid, "malformed message: %v", err)
+  }
+  if dec.More() {
+    return protoErrorf(ErrInvalid, "malformed message: trailing data")
+  }
+  return nil
+}
+
+// toNativeTypedOp()
+// Converts an op received under ProtoTyped. Clients may only send
+// inserts and deletes.
+func toNativeTypedOp(sOp SOp) (Op, error) {
+  ret := Op{ID: sOp.ID, Version: sOp.Version, Position: sOp.Position,
+            Value: sOp.Value}
+  opcode, err := parseOpType(sOp.Type)
+  if err != nil {
+    return ret, err
+  }
+  ret.Type = opcode
+  return ret, nil
+}
+
+func parseOpType(s string) (int, error) {
+  if s == "Insert" {
+    return InsertOp, nil
+  } else if s == "Delete" {
+    return DeleteOp, nil
+  }
+  return NoOp, protoErrorf(ErrUnknownOpType, "unknown op type %q", s)
+}
+
+// checkBatch()
+// Checks that ops are not empty and all by one client at one Version.
+func checkBatch(ops []Op) error {
+  if len(ops) == 0 {
+    return protoErrorf(ErrInvalid, "empty batch")
+  }
+  for _, op := range ops[1:] {
+    if op.ID != ops[0].ID || op.Version != ops[0].Version {
+      return protoErrorf(ErrInvalid, "mixed ID or Version in batch")
+    }
+  }
+  return nil
+}
+
+func toStringOps(ops []Op) []SOp {
+  ret := make([]SOp, len(ops))
+  for i, op := range ops {
+    ret[i] = toStringOp(op)
+  }
+  return ret
+}
+
+// decodeOpenPad()
+// Parses the argument of an "open pad" message.
+func decodeOpenPad(typed bool, arg string) (openRequest, error) {
+  if !typed {
+    return parseOpenPad(arg)
+  }
+  var ret openRequest
+  var msg OpenPadMsg
+  if err := decodeStrict(arg, &msg); err != nil {
+    return ret, err
+  }
+  ret.PadId = msg.PadId
+  ret.Since = msg.Since
+  for _, sOp := range msg.Pending {
+    op, err := toNativeTypedOp(sOp)
+    if err != nil {
+      return ret, err
+    }
+    ret.Pending = append(ret.Pending, op)
+  }
+  return ret, nil
+}
+
+// decodeOp()
+// Parses the argument of an "op" message, and returns its Ref too.
+func decodeOp(typed bool, arg string) (Op, uint64, error) {
+  if !typed {
+    sOp := make(map[string]string)
+    if err := json.Unmarshal([]byte(arg), &sOp); err != nil {
+      return Op{}, 0, err
+    }
+    op, err := toNativeOp(sOp)
+    return op, 0, err
+  }
+  var msg OpMsg
+  if err := decodeStrict(arg, &msg); err != nil {
+    return Op{}, 0, err
+  }
+  op, err := toNativeTypedOp(msg.Op)
+  return op, msg.Ref, err
+}
+
+// decodeBatch()
+// Parses the argument of an "op batch" message, and returns its Ref
+// too.
+func decodeBatch(typed bool, arg string) ([]Op, uint64, error) {
+  if !typed {
+    var sOps []map[string]string
+    if err := json.Unmarshal([]byte(arg), &sOps); err != nil {
+      return nil, 0, err
+    }
+    ops, err := toNativeBatch(sOps)
+    return ops, 0, err
+  }
+  var msg BatchMsg
+  if err := decodeStrict(arg, &msg); err != nil {
+    return nil, 0, err
+  }
+  ops := make([]Op, len(msg.Ops))
+  for i, sOp := range msg.Ops {
+    op, err := toNativeTypedOp(sOp)
+    if err != nil {
+      return nil, msg.Ref, err
+    }
+    ops[i] = op
+  }
+  return ops, msg.Ref, checkBatch(ops)
+}
+
+func emitJSON(t Transport, event string, v interface{}) {
+  data, err := json.Marshal(v)
+  assert(err == nil, "emitJSON")
+  t.Emit(event, string(data))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+  fmt.Printf("Test: Protocol negotiation ...\n")
+
+  reply, err := negotiate(HelloMsg{Versions: []int{1, 2, 7}})
+  if err != nil || reply.Version != ProtoTyped ||
+     !reflect.DeepEqual(reply.Capabilities, Capabilities) {
+    t.Fatalf("got %+v, %v; want version 2 with every capability",
+             reply, err)
+  }
+  reply, err = negotiate(HelloMsg{Versions: []int{2},
+                                  Capabilities: []string{"batch", "x"}})
+  if err != nil || !reflect.DeepEqual(reply.Capabilities, []string{"batch"}) {
+    t.Fatalf("got %+v, %v; want only batch", reply, err)
+  }
+  reply, err = negotiate(HelloMsg{Versions: []int{1}})
+  if err != nil || reply.Version != ProtoLegacy ||
+     len(reply.Capabilities) != 0 {
+    t.Fatalf("got %+v, %v; want version 1", reply, err)
+  }
+  _, err = negotiate(HelloMsg{Versions: []int{0, 3}})
+  if errorCode(err, "") != ErrUnsupported {
+    t.Fatalf("got %v; want %v", err, ErrUnsupported)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDecodeTyped(t *testing.T) {
+  fmt.Printf("Test: Typed messages are decoded strictly ...\n")
+
+  op, ref, err := decodeOp(true, `{"Ref": 9, "Op": {"ID": 5, "Version": 3, ` +
+                                  `"Type": "Insert", "Position": 1, "Value": "x"}}`)
+  want := Op{ID: 5, Version: 3, Type: InsertOp, Position: 1, Value: "x"}
+  if err != nil || ref != 9 || op != want {
+    t.Fatalf("got %+v, %v, %v", op, ref, err)
+  }
+
+  bad := []struct {
+    arg  string
+    code string
+  }{
+    {`{"Ref": 1, "Op": {"Type": "Move"}}`, ErrUnknownOpType},
+    {`{"Ref": 1, "Op": {"Type": "NoOp"}}`, ErrUnknownOpType},
+    {`{"Ref": 1, "Op": {}}`, ErrUnknownOpType},
+    {`{"Ref": 1, "Op": {"Type": "Insert", "Version": "3"}}`, ErrInvalid},
+    {`{"Ref": 1, "Op": {"Type": "Insert", "Position": -1}}`, ErrInvalid},
+    {`{"Ref": 1, "Op": {"Type": "Insert", "Extra": 1}}`, ErrInvalid},
+    {`{"Ref": 1} {}`, ErrInvalid},
+    {`"op"`, ErrInvalid},
+  }
+  for _, b := range bad {
+    if _, _, err := decodeOp(true, b.arg); errorCode(err, "") != b.code {
+      t.Fatalf("%v: got %v, want %v", b.arg, err, b.code)
+    }
+  }
+
+  // legacy ops no longer turn unknown types into noops either
+  _, _, err = decodeOp(false, `{"ID": "5", "Version": "3", "Type": "Move", ` +
+                              `"Position": "1", "Value": "x"}`)
+  if errorCode(err, "") != ErrUnknownOpType {
+    t.Fatalf("legacy op of unknown type: got %v", err)
+  }
+
+  ops, ref, err := decodeBatch(true, `{"Ref": 4, "Ops": [` +
+    `{"ID": 5, "Version": 3, "Type": "Insert", "Position": 1, "Value": "x"},` +
+    `{"ID": 5, "Version": 3, "Type": "Delete", "Position": 0}]}`)
+  if err != nil || ref != 4 || len(ops) != 2 || ops[1].Type != DeleteOp {
+    t.Fatalf("batch: got %+v, %v, %v", ops, ref, err)
+  }
+  _, ref, err = decodeBatch(true, `{"Ref": 4, "Ops": []}`)
+  if ref != 4 || errorCode(err, "") != ErrInvalid {
+    t.Fatalf("empty batch: got %v, %v", ref, err)
+  }
+
+  req, err := decodeOpenPad(true, `{"PadId": "001", "Since": 2, "Pending": ` +
+    `[{"ID": 5, "Version": 2, "Type": "Insert", "Position": 0, "Value": "x"}]}`)
+  if err != nil || req.PadId != "001" || req.Since != 2 ||
+     len(req.Pending) != 1 {
+    t.Fatalf("open pad: got %+v, %v", req, err)
+  }
+  // pad ids are not JSON under ProtoTyped
+  if _, err := decodeOpenPad(true, "001"); errorCode(err, "") != ErrInvalid {
+    t.Fatalf("bare pad id: got %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
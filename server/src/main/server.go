@@ -4,12 +4,15 @@ import (
   "os"
   "log"
   "fmt"
-  "sync"
+  "flag"
+  "time"
   "strconv"
+  "strings"
   "errors"
   "encoding/json"
   "net/http"
   "github.com/googollee/go-socket.io"
+  "logger"
 )
 
 const (
@@ -17,90 +20,92 @@ const (
 )
 
 // boring parsing stuff 1.0
-func spawnServer(pxpeers []string, me int, wg *sync.WaitGroup) {
+
+// spawnServer()
+// Runs replica me until its HTTP server fails, and returns why.
+func spawnServer(pxpeers []string, me int, cfg ServerConfig) error {
   server, err := socketio.NewServer(nil)
   if err != nil {
-      log.Fatal(err)
+      cfg.Logger.Error("socket.io setup failed", "err", err)
+      return err
   }
 
-  // we need the server argument because paxos needs it to send
-  // broadcast messages when an operation is committed
-  es := NewEPServer(pxpeers, me, server)
+  // paxos needs the server to send broadcast messages when an
+  // operation is committed
+  es := NewEPServer(pxpeers, me, sioBroadcaster{server}, cfg)
   
   server.On("connection", func(so socketio.Socket) {
-    // Client should first send a "open pad" message, with "pad id"
-    // (an integer in string format) as the argument
-    // all subsequent edits are assumed to be operating on this pad
-    so.On("open pad", func(pad string) {
-      if len(so.Rooms()) > 1 {
-        so.Emit("error", "alreay opened")
-        return
-      }
-
-      // wrapping mutex around it because socketio not thread-safe
-      // this is cumbersome and should be fixed later
-      es.mu.Lock()
-      so.Join(pad)
-      es.mu.Unlock()
-      pm := es.getPadById(pad)
-      es.socketCheckIn(so.Id(), pad)
-      piJSON, err := json.Marshal(pm.getLatestInfo())
-      assert(err == nil, "panic 1")
-      so.Emit("init_comt_op", string(piJSON[:]))
-      return
-    })
-
-    // An "op" message's argument is a JSON string with all string
-    // fields. Field names should be kept consistent with Op{} in
-    // common.go, case-sensitive.
-    so.On("op", func(opJSON string) {
-      log.Printf("received op %v\n", opJSON)
-      padId, ok := es.lookupPadId(so.Id())
-      if !ok {
-        so.Emit("error", "not checked in")
-        return
-      }
-      sOp := make(map[string]string)
-      err := json.Unmarshal([]byte(opJSON), &sOp)
-      if err != nil {
-        log.Printf("invalid op1 %v\n", opJSON)
-        so.Emit("error", "invalid op")
-        return
-      }
-      op, err := toNativeOp(sOp)
-      if err != nil {
-        log.Printf("invalid op2\n")
-        so.Emit("error", "invalid op")
-        return
-      }
-      // do not emit anything here, use paxos to do the correct
-      // thing when a committed operation is discovered
-      es.processOp(padId, op)
-      return
-    })
-
+    c := newClientConn(es, sioTransport{so}, ProtoLegacy)
+    for _, event := range clientEvents {
+      event := event
+      so.On(event, func(arg string) {
+        c.handle(event, arg)
+      })
+    }
     so.On("disconnection", func(){
-      es.socketCheckOut(so.Id())
+      c.close()
     })
   })
   
   server.On("error", func(so socketio.Socket, err error) {
-    log.Println("error:", err)
+    es.log.Warn("socket.io error", "socket", so.Id(), "err", err)
   })
 
   es.startAutoApply()
 
   srvMux := http.NewServeMux()
   srvMux.Handle("/socket.io/", server)
+  srvMux.HandleFunc("/ws", es.serveWS)
+  srvMux.HandleFunc(API_PREFIX, es.serveAPI)
+  srvMux.HandleFunc("/metrics", es.serveMetrics)
+  srvMux.HandleFunc("/status", es.serveStatus)
+  srvMux.HandleFunc("/healthz", es.serveHealthz)
   srvMux.Handle("/", http.FileServer(http.Dir("../../../socket_editting/public/")))
   port := 8080
   portStr := fmt.Sprintf(":%v", port+me)
-  log.Printf("Server %v running at localhost%v\n", me, portStr)
-  log.Fatal(http.ListenAndServe(portStr, srvMux))
-  wg.Done()
+  es.log.Info("running", "addr", "localhost"+portStr)
+  err = http.ListenAndServe(portStr, srvMux)
+  es.log.Error("http server failed", "err", err)
+  return err
+}
+
+// sioTransport is the Transport of a socket.io connection, whose pad
+// rooms socket.io keeps itself.
+type sioTransport struct {
+  so socketio.Socket
+}
+
+func (t sioTransport) Id() string {
+  return t.so.Id()
+}
+
+func (t sioTransport) Request() *http.Request {
+  return t.so.Request()
+}
+
+func (t sioTransport) Emit(event string, arg string) {
+  t.so.Emit(event, arg)
+}
+
+func (t sioTransport) Join(padId string) {
+  t.so.Join(padId)
+}
+
+// sioBroadcaster publishes to the pad rooms socket.io keeps.
+type sioBroadcaster struct {
+  srv *socketio.Server
+}
+
+func (b sioBroadcaster) Broadcast(padId string, event string, arg string) {
+  b.srv.BroadcastTo(padId, event, arg)
 }
 
 // boring parsing stuff 2.0
+// toNativeOp()
+// Parses an op sent by a client. Position is taken as is: clients
+// count UTF-16 code units, and so does PadManager. A delete need not
+// name the character it removes; it removes the code point at
+// Position.
 func toNativeOp(sOp map[string]string) (Op, error) {
   var ret Op
   var v interface{}
@@ -119,15 +124,10 @@ func toNativeOp(sOp map[string]string) (Op, error) {
   ret.Version = v.(uint64)
   
   if s, ok := sOp["Type"]; ok {
-    var opcode int
-    if s == "Insert" {
-      opcode = InsertOp
-    } else if s == "Delete" {
-      opcode = DeleteOp
-    } else {
-      opcode = NoOp
+    ret.Type, err = parseOpType(s)
+    if err != nil {
+      return ret, err
     }
-    ret.Type = opcode
   } else {
     return ret, errors.New("Key not found: Type")
   }
@@ -147,6 +147,64 @@ func toNativeOp(sOp map[string]string) (Op, error) {
   return ret, err
 }
 
+// openRequest is what an "open pad" message asks for.
+type openRequest struct {
+  PadId   string
+  Since   uint64 // revision the client has seen up to
+  Pending []Op   // ops the client queued on top of Since
+}
+
+// parseOpenPad()
+// Parses the argument of an "open pad" message, which is either a pad
+// id, or a JSON object resuming a pad the client has seen before:
+// {"PadId": "<id>", "Since": "<revision>", "Pending": [<op>, ...]},
+// with string fields, and ops in the same form as "op" messages.
+func parseOpenPad(arg string) (openRequest, error) {
+  var ret openRequest
+  if !strings.HasPrefix(arg, "{") {
+    ret.PadId = arg
+    return ret, nil
+  }
+  var req struct {
+    PadId   string
+    Since   string
+    Pending []map[string]string
+  }
+  if err := json.Unmarshal([]byte(arg), &req); err != nil {
+    return ret, err
+  }
+  ret.PadId = req.PadId
+  v, err := checkAndParse("uint64", "Since", map[string]string{
+                            "Since": req.Since})
+  if err != nil {
+    return ret, err
+  }
+  ret.Since = v.(uint64)
+  for _, sOp := range req.Pending {
+    op, err := toNativeOp(sOp)
+    if err != nil {
+      return ret, err
+    }
+    ret.Pending = append(ret.Pending, op)
+  }
+  return ret, nil
+}
+
+// toNativeBatch()
+// Parses the ops of an "op batch" message, which must be by one
+// client and at one Version.
+func toNativeBatch(sOps []map[string]string) ([]Op, error) {
+  ret := make([]Op, len(sOps))
+  for i, sOp := range sOps {
+    op, err := toNativeOp(sOp)
+    if err != nil {
+      return nil, err
+    }
+    ret[i] = op
+  }
+  return ret, checkBatch(ret)
+}
+
 func checkAndParse(dtype string, key string,
                    sOp map[string]string) (interface{}, error) {
   s, ok := sOp[key]
@@ -178,17 +236,65 @@ func port(host int) string {
 }
 
 func main() {
+  authSecret := flag.String("auth-secret", "",
+    "secret for verifying client tokens; authentication is disabled if empty")
+  mintToken := flag.String("mint-token", "",
+    "print a token for the given user id, signed with -auth-secret, and exit")
+  tokenTTL := flag.Duration("token-ttl", 24*time.Hour,
+    "validity period of tokens printed by -mint-token")
+  var cfg ServerConfig
+  flag.Float64Var(&cfg.Limits.OpRate, "op-rate", 50,
+    "ops per second a socket may send; 0 for no limit")
+  flag.IntVar(&cfg.Limits.OpBurst, "op-burst", 100,
+    "ops a socket may send in a burst above -op-rate")
+  flag.IntVar(&cfg.Limits.MaxPadSize, "max-pad-size", 1<<20,
+    "maximum length of a pad in UTF-16 code units; 0 for no limit")
+  flag.IntVar(&cfg.Limits.MaxValueLen, "max-op-len", 1<<10,
+    "maximum length of a single op's Value in UTF-16 code units; " +
+    "0 for no limit")
+  flag.IntVar(&cfg.Limits.MaxBatchLen, "max-batch", 1000,
+    "maximum number of ops in an op batch; 0 for no limit")
+  flag.DurationVar(&cfg.RPCTimeout, "rpc-timeout", time.Second,
+    "time after which an unanswered paxos message counts as lost")
+  flag.IntVar(&cfg.Pipeline, "pipeline", DEFAULT_PIPELINE,
+    "how many log entries a replica may be appending at once")
+  flag.IntVar(&cfg.History, "history", DEFAULT_HISTORY,
+    "revisions of history kept per pad; must be the same on all replicas")
+  logLevel := flag.String("log-level", "info",
+    "minimum level of log lines: debug, info, warn or error")
+  flag.Parse()
+
+  level, err := logger.ParseLevel(*logLevel)
+  if err != nil {
+    log.Fatal(err)
+  }
+  cfg.Logger = logger.New(os.Stderr, level)
+  assertLog = cfg.Logger
+
+  if *authSecret != "" {
+    ta := NewTokenAuthenticator([]byte(*authSecret))
+    if *mintToken != "" {
+      fmt.Println(ta.MintToken(*mintToken, *tokenTTL))
+      return
+    }
+    cfg.Auth = ta
+  } else if *mintToken != "" {
+    log.Fatal("-mint-token requires -auth-secret")
+  }
+
   pxpeers := make([]string, 0)
   for i := 0; i < PXCONFIG; i++ {
     pxpeers = append(pxpeers, port(i))
   }
 
-  var wg sync.WaitGroup
+  // the replicas only stop on failure, and one failing takes the
+  // others down with it
+  failed := make(chan error, PXCONFIG)
   for i := 0; i < PXCONFIG; i++ {
-    wg.Add(1)
-    go spawnServer(pxpeers, i, &wg)
+    go func(i int) {
+      failed <- spawnServer(pxpeers, i, cfg)
+    }(i)
   }
-  wg.Wait()
-
-  return
+  <-failed
+  os.Exit(1)
 }
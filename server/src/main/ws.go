@@ -0,0 +1,158 @@
+package main
+
+//
+// The plain WebSocket endpoint, /ws, for clients without a socket.io
+// library. It speaks the same pad protocol (see protocol.go) with one
+// JSON frame per message, in both directions:
+//
+//   {"Event": "op", "Data": {"Ref": 1, "Op": {...}}}
+//
+// Data is the message argument inline, or a JSON string holding it
+// as socket.io would. Connections speak ProtoTyped from the start;
+// a "hello" is still answered.
+//
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "net/http"
+  "encoding/json"
+  "github.com/gorilla/websocket"
+)
+
+const WS_QUEUE_LEN = 256              // frames queued per connection
+const WS_WRITE_TIMEOUT = 10 * time.Second
+
+// browsers may only connect from the page's own origin
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 1024,
+                                    WriteBufferSize: 1024}
+
+type wsFrame struct {
+  Event string
+  Data  json.RawMessage
+}
+
+// wsConn is the Transport of a WebSocket connection. Its pad room is
+// kept in the EPServer's hub.
+type wsConn struct {
+  es   *EPServer
+  id   string
+  req  *http.Request
+  ws   *websocket.Conn
+  out  chan []byte // frames for writeLoop()
+  done chan bool   // closed on shutdown()
+  once sync.Once
+}
+
+func (c *wsConn) Id() string {
+  return c.id
+}
+
+func (c *wsConn) Request() *http.Request {
+  return c.req
+}
+
+// wsConn::Emit():
+// Queues a frame without blocking. A connection too slow to keep up
+// with its pad is closed; it can reconnect and resume.
+func (c *wsConn) Emit(event string, arg string) {
+  select {
+  case <-c.done:
+  case c.out <- encodeFrame(event, arg):
+  default:
+    c.es.log.Info("websocket too slow, closing", "socket", c.id)
+    c.shutdown()
+  }
+}
+
+func (c *wsConn) Join(padId string) {
+  c.es.hub.join(padId, c)
+}
+
+func (c *wsConn) shutdown() {
+  c.once.Do(func() {
+    close(c.done)
+    c.ws.Close()
+  })
+}
+
+func (c *wsConn) writeLoop() {
+  for {
+    select {
+    case frame := <-c.out:
+      c.ws.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+      if err := c.ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+        c.shutdown()
+        return
+      }
+    case <-c.done:
+      return
+    }
+  }
+}
+
+// EPServer::serveWS():
+// Serves one WebSocket connection until it closes. Messages are
+// handled in the order they arrive.
+func (es *EPServer) serveWS(w http.ResponseWriter, r *http.Request) {
+  ws, err := wsUpgrader.Upgrade(w, r, nil)
+  if err != nil {
+    // the upgrader has answered the request already
+    es.log.Info("websocket upgrade failed", "err", err)
+    return
+  }
+  wc := &wsConn{es: es, req: r, ws: ws}
+  wc.id = fmt.Sprintf("ws-%v", nrand())
+  wc.out = make(chan []byte, WS_QUEUE_LEN)
+  wc.done = make(chan bool)
+  go wc.writeLoop()
+
+  c := newClientConn(es, wc, ProtoTyped)
+  for {
+    _, msg, err := ws.ReadMessage()
+    if err != nil {
+      break
+    }
+    event, arg, err := decodeFrame(msg)
+    if err != nil {
+      c.fail(ErrInvalid, err.Error(), 0)
+      continue
+    }
+    c.handle(event, arg)
+  }
+  es.hub.leave(wc)
+  c.close()
+  wc.shutdown()
+}
+
+// encodeFrame()
+// Makes the frame of a message. Arguments that are not JSON, like
+// the errors of ProtoLegacy, are sent as JSON strings.
+func encodeFrame(event string, arg string) []byte {
+  data := []byte(arg)
+  if !json.Valid(data) {
+    data, _ = json.Marshal(arg)
+  }
+  frame, err := json.Marshal(wsFrame{event, data})
+  assert(err == nil, "encodeFrame")
+  return frame
+}
+
+// decodeFrame()
+// Returns the event and argument of a frame, the argument as
+// socket.io would pass it.
+func decodeFrame(msg []byte) (string, string, error) {
+  var frame wsFrame
+  if err := json.Unmarshal(msg, &frame); err != nil || frame.Event == "" {
+    return "", "", fmt.Errorf("malformed frame")
+  }
+  if len(frame.Data) > 0 && frame.Data[0] == '"' {
+    var arg string
+    if err := json.Unmarshal(frame.Data, &arg); err != nil {
+      return "", "", fmt.Errorf("malformed frame")
+    }
+    return frame.Event, arg, nil
+  }
+  return frame.Event, string(frame.Data), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// fakeTransport records what a connection is sent, and keeps its pad
+// room in the hub like a WebSocket connection.
+type fakeTransport struct {
+  mu   sync.Mutex
+  es   *EPServer
+  id   string
+  req  *http.Request // the handshake, if not empty
+  sent []string      // "event arg"
+}
+
+func (t *fakeTransport) Id() string {
+  return t.id
+}
+
+func (t *fakeTransport) Request() *http.Request {
+  if t.req == nil {
+    return &http.Request{}
+  }
+  return t.req
+}
+
+func (t *fakeTransport) Emit(event string, arg string) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.sent = append(t.sent, event+" "+arg)
+}
+
+func (t *fakeTransport) Join(padId string) {
+  t.es.hub.join(padId, t)
+}
+
+// take returns what t was sent since the last call.
+func (t *fakeTransport) take() []string {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  ret := t.sent
+  t.sent = nil
+  return ret
+}
+
+func TestClientConn(t *testing.T) {
+  fmt.Printf("Test: Clients without socket.io share the pad rooms ...\n")
+
+  esa := makeReplicas(t, "conn", 3, 4)
+  defer cleanup(esa)
+
+  t1 := &fakeTransport{es: esa[0], id: "ws-1"}
+  t2 := &fakeTransport{es: esa[0], id: "ws-2"}
+  c1 := newClientConn(esa[0], t1, ProtoTyped)
+  c2 := newClientConn(esa[0], t2, ProtoTyped)
+
+  c1.handle("op", `{"Ref": 1, "Op": {}}`)
+  if got := t1.take(); len(got) != 1 ||
+     !strings.Contains(got[0], ErrNotOpen) {
+    t.Fatalf("op before open pad: got %v", got)
+  }
+  c1.handle("open pad", `{"PadId": "pad"}`)
+  c2.handle("open pad", `{"PadId": "pad"}`)
+  for _, tr := range []*fakeTransport{t1, t2} {
+    if got := tr.take(); len(got) != 1 ||
+       !strings.HasPrefix(got[0], "init_comt_op ") {
+      t.Fatalf("open pad: got %v", got)
+    }
+  }
+
+  c1.handle("op", `{"Ref": 7, "Op": {"ID": 1, "Version": 0, ` +
+                  `"Type": "Insert", "Position": 0, "Value": "a"}}`)
+  bcast := `op {"ID":1,"Version":0,"Type":"Insert","Position":0,"Value":"a"}`
+  got := t1.take()
+  if len(got) != 2 || got[0] != bcast || !strings.HasPrefix(got[1], "ack ") ||
+     !strings.Contains(got[1], `"Ref":7`) {
+    t.Fatalf("sender: got %v", got)
+  }
+  if got := t2.take(); len(got) != 1 || got[0] != bcast {
+    t.Fatalf("other client: got %v, want %v", got, bcast)
+  }
+
+  // once gone, a connection is sent nothing
+  esa[0].hub.leave(t2)
+  c2.close()
+  c1.handle("op", `{"Ref": 8, "Op": {"ID": 1, "Version": 1, ` +
+                  `"Type": "Insert", "Position": 1, "Value": "b"}}`)
+  if got := t2.take(); len(got) != 0 {
+    t.Fatalf("after leaving: got %v", got)
+  }
+  if text := esa[0].getPadById("pad").getText(); text != "ab" {
+    t.Fatalf("text %q, want %q", text, "ab")
+  }
+
+  c1.handle("move", `{}`)
+  if got := t1.take(); len(got) != 3 ||
+     !strings.Contains(got[2], ErrInvalid) {
+    t.Fatalf("unknown message: got %v", got)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWSFrames(t *testing.T) {
+  fmt.Printf("Test: WebSocket frames ...\n")
+
+  frame := encodeFrame("ack", `{"Ref":1,"Ops":[]}`)
+  if string(frame) != `{"Event":"ack","Data":{"Ref":1,"Ops":[]}}` {
+    t.Fatalf("typed frame: got %s", frame)
+  }
+  // legacy errors are not JSON
+  frame = encodeFrame("error", "not checked in")
+  if string(frame) != `{"Event":"error","Data":"not checked in"}` {
+    t.Fatalf("string frame: got %s", frame)
+  }
+
+  cases := []struct {
+    msg   string
+    event string
+    arg   string
+  }{
+    {`{"Event": "open pad", "Data": {"PadId": "001"}}`,
+     "open pad", `{"PadId": "001"}`},
+    {`{"Event": "open pad", "Data": "001"}`, "open pad", "001"},
+    {`{"Event": "share link"}`, "share link", ""},
+  }
+  for _, c := range cases {
+    event, arg, err := decodeFrame([]byte(c.msg))
+    if err != nil || event != c.event || arg != c.arg {
+      t.Fatalf("%v: got %q, %q, %v", c.msg, event, arg, err)
+    }
+  }
+  for _, msg := range []string{`{"Data": {}}`, `[]`, `{"Event": "op"`} {
+    if _, _, err := decodeFrame([]byte(msg)); err == nil {
+      t.Fatalf("%v: decoded", msg)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
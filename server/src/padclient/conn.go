@@ -0,0 +1,130 @@
+package padclient
+
+import (
+  "time"
+  "strings"
+  "net/http"
+  "encoding/json"
+  "github.com/gorilla/websocket"
+)
+
+const DIAL_TIMEOUT = 5 * time.Second
+
+// The messages of the pad protocol the client uses, as in the
+// server's protocol.go.
+type frame struct {
+  Event string
+  Data  json.RawMessage
+}
+
+type helloMsg struct {
+  Versions []int
+}
+
+type openPadMsg struct {
+  PadId   string
+  Since   uint64
+  Pending []Op
+}
+
+type opMsg struct {
+  Ref uint64
+  Op  Op
+}
+
+type batchMsg struct {
+  Ref uint64
+  Ops []Op
+}
+
+type padInfo struct {
+  PadId    string
+  Version  uint64
+  Base     uint64
+  Snapshot bool
+  Text     string
+  Ops      []Op
+}
+
+type errorMsg struct {
+  Code    string
+  Message string
+  Ref     uint64
+}
+
+// wsConn is what the client needs of a WebSocket connection.
+type wsConn interface {
+  ReadMessage() (int, []byte, error)
+  WriteMessage(messageType int, data []byte) error
+  SetReadDeadline(t time.Time) error
+  Close() error
+}
+
+// dialWS()
+// Connects to the /ws endpoint of the replica at addr, which is
+// host:port or a ws:// URL.
+func dialWS(addr string, token string) (wsConn, error) {
+  url := addr
+  if !strings.Contains(url, "://") {
+    url = "ws://" + addr + "/ws"
+  }
+  header := http.Header{}
+  if token != "" {
+    header.Set("Authorization", "Bearer "+token)
+  }
+  d := websocket.Dialer{HandshakeTimeout: DIAL_TIMEOUT}
+  ws, _, err := d.Dial(url, header)
+  if err != nil {
+    return nil, err
+  }
+  return ws, nil
+}
+
+func writeFrame(ws wsConn, event string, v interface{}) error {
+  data, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+  msg, err := json.Marshal(frame{event, data})
+  if err != nil {
+    return err
+  }
+  return ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+func readFrame(ws wsConn) (string, []byte, error) {
+  _, msg, err := ws.ReadMessage()
+  if err != nil {
+    return "", nil, err
+  }
+  var f frame
+  if err := json.Unmarshal(msg, &f); err != nil {
+    return "", nil, err
+  }
+  return f.Event, f.Data, nil
+}
+
+// decodeData()
+// Decodes the argument of a frame, which replicas may also send as a
+// JSON string holding it.
+func decodeData(data []byte, v interface{}) error {
+  if len(data) > 0 && data[0] == '"' {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+      return err
+    }
+    data = []byte(s)
+  }
+  return json.Unmarshal(data, v)
+}
+
+func decodeError(data []byte) error {
+  var em errorMsg
+  if err := decodeData(data, &em); err != nil {
+    // a plain string, from a replica speaking the legacy protocol
+    var s string
+    json.Unmarshal(data, &s)
+    return &ServerError{"unknown", s}
+  }
+  return &ServerError{em.Code, em.Message}
+}
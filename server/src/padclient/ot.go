@@ -0,0 +1,104 @@
+package padclient
+
+import (
+  "unicode"
+  "unicode/utf16"
+)
+
+// Op is an op as replicas send and receive it. Positions and lengths
+// count UTF-16 code units.
+type Op struct {
+  ID       int64  // the client that made it
+  Version  uint64 // the revision it applies to
+  Type     string // "Insert", "Delete" or "NoOp"
+  Position uint64
+  Value    string // inserted text, or the code point deleted
+}
+
+// length()
+// Returns how many code units op inserts or deletes. A delete without
+// a Value removes a single unit.
+func (op Op) length() uint64 {
+  n := uint64(len(utf16.Encode([]rune(op.Value))))
+  if op.Type == "Delete" && n == 0 {
+    return 1
+  }
+  return n
+}
+
+// apply()
+// Returns text with op applied. Positions past the end are clamped,
+// as replicas do.
+func apply(text []uint16, op Op) []uint16 {
+  pos := op.Position
+  if pos > uint64(len(text)) {
+    pos = uint64(len(text))
+  }
+  switch op.Type {
+  case "Insert":
+    ins := utf16.Encode([]rune(op.Value))
+    out := make([]uint16, 0, len(text)+len(ins))
+    out = append(out, text[:pos]...)
+    out = append(out, ins...)
+    return append(out, text[pos:]...)
+  case "Delete":
+    end := pos + op.length()
+    if end > uint64(len(text)) {
+      end = uint64(len(text))
+    }
+    out := make([]uint16, 0, len(text))
+    out = append(out, text[:pos]...)
+    return append(out, text[end:]...)
+  }
+  return text
+}
+
+// transform()
+// Transforms op1 to apply after op2, where both apply to the same
+// revision. Where both insert at the same position, op2's text goes
+// first if op2First. These are the rules of opTransform() in the
+// server; a client that used others would diverge from it.
+func transform(op1 *Op, op2 Op, op2First bool) {
+  l2 := op2.length()
+  switch {
+  case op1.Type == "Insert" && op2.Type == "Insert":
+    if op2.Position < op1.Position ||
+       (op2.Position == op1.Position && op2First) {
+      op1.Position += l2
+    }
+  case op1.Type == "Insert" && op2.Type == "Delete":
+    if op2.Position+l2 <= op1.Position {
+      op1.Position -= l2
+    } else if op2.Position < op1.Position {
+      op1.Position = op2.Position
+    }
+  case op1.Type == "Delete" && op2.Type == "Insert":
+    if op2.Position <= op1.Position {
+      op1.Position += l2
+    }
+  case op1.Type == "Delete" && op2.Type == "Delete":
+    if op2.Position+l2 <= op1.Position {
+      op1.Position -= l2
+    } else if op2.Position <= op1.Position {
+      op1.Type = "NoOp"
+    }
+  }
+}
+
+// transformPast()
+// Transforms the sequence ops and the committed op h, which apply to
+// the same revision, past each other. Where both insert at one
+// position, h goes first, as it does on the replicas.
+func transformPast(ops []Op, h Op) ([]Op, Op) {
+  out := make([]Op, len(ops))
+  for i, op := range ops {
+    out[i] = op
+    transform(&out[i], h, true)
+    transform(&h, op, false)
+  }
+  return out, h
+}
+
+func isPair(hi uint16, lo uint16) bool {
+  return utf16.DecodeRune(rune(hi), rune(lo)) != unicode.ReplacementChar
+}
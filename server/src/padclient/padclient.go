@@ -0,0 +1,557 @@
+package padclient
+
+//
+// A Go client for pads, talking to the replicas' /ws endpoint.
+//
+// c, err := padclient.Open(padclient.Config{
+//   Replicas: []string{"localhost:8080", "localhost:8081"}}, "001")
+// c.Insert(c.Len(), "build passed\n")
+// err = c.Sync(5 * time.Second) // wait for the replicas to commit it
+// c.Close()
+//
+// The client keeps a copy of the pad, which is the text at the last
+// revision it has seen plus its own ops the replicas have not
+// committed yet. Ops of other clients are transformed past those
+// pending ops, with the same rules the replicas use, so the copy ends
+// up as the replicas' text. When its replica goes away the client
+// resumes on the next one, handing over its pending ops.
+//
+
+import (
+  "fmt"
+  "sync"
+  "strings"
+  "time"
+  "errors"
+  "math/big"
+  "crypto/rand"
+  "unicode/utf16"
+  "logger"
+)
+
+const RECONNECT_MIN = 100 * time.Millisecond // backoff between replicas
+const RECONNECT_MAX = 5 * time.Second
+const OPEN_TIMEOUT = 10 * time.Second // for a replica to open the pad
+const RETRY_MIN = 100 * time.Millisecond // before resending rate limited ops
+const MAX_BATCH = 100 // ops sent in one message
+
+var ErrClosed = errors.New("padclient: closed")
+var ErrTimeout = errors.New("padclient: ops not committed in time")
+var ErrOpsLost = errors.New("padclient: pending ops were dropped; " +
+                            "the replicas no longer keep their revision")
+var ErrPosition = errors.New("padclient: position out of range")
+
+// ServerError is an error a replica answered with. The codes are
+// those of the server's protocol.go.
+type ServerError struct {
+  Code    string
+  Message string
+}
+
+func (e *ServerError) Error() string {
+  return fmt.Sprintf("padclient: %v: %v", e.Code, e.Message)
+}
+
+// fatal()
+// Reports whether another replica would answer the same.
+func (e *ServerError) fatal() bool {
+  return e.Code != "unknown_revision" && !e.throttled()
+}
+
+// throttled()
+// Reports whether the replica refused to commit ops only for now,
+// because they came too fast.
+func (e *ServerError) throttled() bool {
+  return e.Code == "limit_exceeded" &&
+         strings.HasPrefix(e.Message, "rate limit")
+}
+
+type Config struct {
+  Replicas []string       // host:port of each replica, tried in turn
+  Token    string         // authentication token, if replicas want one
+  ID       int64          // identifies this client's ops; random if zero
+  Logger   *logger.Logger // discards if nil
+
+  // called for each op of another client applied to the copy once
+  // Open() has returned, in order, as applied
+  OnOp func(op Op)
+}
+
+type Client struct {
+  cfg   Config
+  padId string
+  dial  func(addr string, token string) (wsConn, error)
+  log   *logger.Logger
+
+  mu      sync.Mutex
+  cond    *sync.Cond // signalled when pending shrinks or the client stops
+  ws      wsConn     // nil while reconnecting
+  replica int        // index of the replica connected to
+  doc     []uint16   // the pad at revision rev, then pending applied
+  rev     uint64     // committed ops seen
+  pending []Op       // own ops not seen committed yet, as they apply
+                     // on top of revision rev
+  sent    int        // of pending, those sent through ws
+  ref     uint64     // of the last message sent
+  retry   time.Duration // last wait to resend ops the rate limit
+                        // refused; zero once ops get committed
+  lost    bool       // pending ops were dropped since the last Sync()
+  err     error      // why the client stopped, if it did
+  closed  bool
+}
+
+// Open()
+// Opens pad padId on the first replica of cfg.Replicas that can.
+func Open(cfg Config, padId string) (*Client, error) {
+  return open(cfg, padId, dialWS)
+}
+
+func open(cfg Config, padId string,
+          dial func(string, string) (wsConn, error)) (*Client, error) {
+  if len(cfg.Replicas) == 0 {
+    return nil, errors.New("padclient: no replicas")
+  }
+  c := &Client{cfg: cfg, padId: padId, dial: dial}
+  c.cond = sync.NewCond(&c.mu)
+  if c.cfg.ID == 0 {
+    id, _ := rand.Int(rand.Reader, big.NewInt(int64(1) << 62))
+    c.cfg.ID = id.Int64() + 1
+  }
+  c.log = cfg.Logger
+  if c.log == nil {
+    c.log = logger.Discard()
+  }
+  c.log = c.log.With("pad", padId, "client", c.cfg.ID)
+
+  var err error
+  for i := range cfg.Replicas {
+    var ws wsConn
+    ws, _, err = c.connect(i)
+    if err == nil {
+      go c.run(ws)
+      return c, nil
+    }
+    c.log.Info("cannot open pad", "replica", cfg.Replicas[i], "err", err)
+    if se, ok := err.(*ServerError); ok && se.fatal() {
+      break
+    }
+  }
+  return nil, err
+}
+
+// Client::connect():
+// Opens the pad on replica i, resuming from the revision seen with
+// the pending ops, and returns the ops of others it brought in. Edits
+// wait until the replica answers.
+func (c *Client) connect(i int) (wsConn, []Op, error) {
+  ws, err := c.dial(c.cfg.Replicas[i], c.cfg.Token)
+  if err != nil {
+    return nil, nil, err
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  req := openPadMsg{PadId: c.padId, Since: c.rev, Pending: []Op{}}
+  for _, op := range c.pending {
+    op.ID, op.Version = c.cfg.ID, c.rev
+    req.Pending = append(req.Pending, op)
+  }
+  err = writeFrame(ws, "hello", helloMsg{Versions: []int{2}})
+  if err == nil {
+    err = writeFrame(ws, "open pad", req)
+  }
+  ws.SetReadDeadline(time.Now().Add(OPEN_TIMEOUT))
+  for err == nil {
+    var event string
+    var data []byte
+    if event, data, err = readFrame(ws); err != nil {
+      break
+    }
+    switch event {
+    case "error":
+      err = decodeError(data)
+    case "init_comt_op":
+      var pi padInfo
+      var applied []Op
+      if err = decodeData(data, &pi); err == nil {
+        applied, err = c.init(pi)
+      }
+      if err == nil {
+        ws.SetReadDeadline(time.Time{})
+        c.ws, c.replica = ws, i
+        c.sent, c.retry = 0, 0
+        c.log.Info("pad opened", "replica", c.cfg.Replicas[i],
+                   "rev", c.rev, "resumed", len(req.Pending))
+        return ws, applied, nil
+      }
+    }
+    // ops broadcast before init_comt_op are in it too
+  }
+  ws.Close()
+  return nil, nil, err
+}
+
+// Client::init():
+// Brings the copy to the revision of the init_comt_op answer pi, and
+// returns the ops of others applied.
+func (c *Client) init(pi padInfo) ([]Op, error) {
+  if pi.Snapshot {
+    // the pending ops were dropped along with the revisions they
+    // applied to
+    if len(c.pending) > 0 {
+      c.lost = true
+      c.pending = nil
+      c.cond.Broadcast()
+    }
+    c.doc = utf16.Encode([]rune(pi.Text))
+    c.rev = pi.Base
+  } else if pi.Base != c.rev {
+    return nil, fmt.Errorf("padclient: resumed at revision %v, not %v",
+                           pi.Base, c.rev)
+  }
+  var ret []Op
+  for _, op := range pi.Ops {
+    applied, err := c.receive(op)
+    if err != nil {
+      return nil, err
+    }
+    if applied != nil {
+      ret = append(ret, *applied)
+    }
+  }
+  return ret, nil
+}
+
+// Client::receive():
+// Takes committed op h into the copy. Returns h as applied, or nil if
+// it was ours or seen before.
+func (c *Client) receive(h Op) (*Op, error) {
+  if h.Version < c.rev {
+    return nil, nil
+  }
+  if h.Version > c.rev {
+    return nil, fmt.Errorf("padclient: missed revision %v", c.rev)
+  }
+  c.rev++
+  if h.ID == c.cfg.ID && len(c.pending) > 0 {
+    c.pending = c.pending[1:]
+    if c.sent > 0 {
+      c.sent--
+    }
+    c.retry = 0
+    c.cond.Broadcast()
+    return nil, nil
+  }
+  c.pending, h = transformPast(c.pending, h)
+  c.doc = apply(c.doc, h)
+  return &h, nil
+}
+
+// Client::run():
+// Takes the ops committed by the replicas, moving on to the next
+// replica whenever one goes away, until the client stops.
+func (c *Client) run(ws wsConn) {
+  for ws != nil {
+    err := c.read(ws)
+    ws.Close()
+    c.mu.Lock()
+    if c.ws == ws {
+      c.ws = nil
+    }
+    stopped := c.closed || c.err != nil
+    if !stopped {
+      if se, ok := err.(*ServerError); ok {
+        c.stop(se)
+        stopped = true
+      }
+    }
+    c.mu.Unlock()
+    if stopped {
+      return
+    }
+    c.log.Info("connection lost", "err", err)
+    ws = c.reconnect()
+  }
+}
+
+func (c *Client) read(ws wsConn) error {
+  for {
+    event, data, err := readFrame(ws)
+    if err != nil {
+      return err
+    }
+    switch event {
+    case "op":
+      var op Op
+      if err := decodeData(data, &op); err != nil {
+        return err
+      }
+      c.mu.Lock()
+      applied, err := c.receive(op)
+      c.flush()
+      c.mu.Unlock()
+      if err != nil {
+        return err
+      }
+      if applied != nil {
+        c.notify([]Op{*applied})
+      }
+    case "error":
+      // the ops it is about are not committed; nothing was sent after
+      // them, so they can be sent again if they only came too fast
+      err := decodeError(data)
+      if se, ok := err.(*ServerError); ok && se.throttled() {
+        c.mu.Lock()
+        c.throttle(ws)
+        c.mu.Unlock()
+        continue
+      }
+      // otherwise the copy cannot be brought back in line with the
+      // replicas
+      return err
+    }
+  }
+}
+
+// Client::throttle():
+// Sends the ops ws was refused again after a while, waiting longer
+// each time they are refused in a row. Holds c.mu.
+func (c *Client) throttle(ws wsConn) {
+  c.sent = 0
+  c.retry *= 2
+  if c.retry == 0 {
+    c.retry = RETRY_MIN
+  }
+  if c.retry > RECONNECT_MAX {
+    c.retry = RECONNECT_MAX
+  }
+  c.log.Info("ops refused, sending them again", "after", c.retry)
+  time.AfterFunc(c.retry, func() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.ws == ws {
+      c.flush()
+    }
+  })
+}
+
+// Client::reconnect():
+// Resumes on the replicas after the one that went away, in turn.
+// Returns nil if the client stops first.
+func (c *Client) reconnect() wsConn {
+  backoff := RECONNECT_MIN
+  n := len(c.cfg.Replicas)
+  for i := 1; ; i++ {
+    c.mu.Lock()
+    stopped := c.closed || c.err != nil
+    replica := (c.replica + i) % n
+    c.mu.Unlock()
+    if stopped {
+      return nil
+    }
+    ws, applied, err := c.connect(replica)
+    if err == nil {
+      c.notify(applied)
+      return ws
+    }
+    c.log.Info("cannot resume", "replica", c.cfg.Replicas[replica],
+               "err", err)
+    if se, ok := err.(*ServerError); ok && se.fatal() {
+      c.mu.Lock()
+      c.stop(se)
+      c.mu.Unlock()
+      return nil
+    }
+    if i%n == 0 {
+      time.Sleep(backoff)
+      backoff *= 2
+      if backoff > RECONNECT_MAX {
+        backoff = RECONNECT_MAX
+      }
+    }
+  }
+}
+
+func (c *Client) notify(ops []Op) {
+  if c.cfg.OnOp == nil {
+    return
+  }
+  for _, op := range ops {
+    c.cfg.OnOp(op)
+  }
+}
+
+// Client::stop():
+// Stops the client for err. Holds c.mu.
+func (c *Client) stop(err error) {
+  if c.err == nil {
+    c.err = err
+  }
+  if c.ws != nil {
+    c.ws.Close()
+    c.ws = nil
+  }
+  c.cond.Broadcast()
+}
+
+// Client::Close():
+// Stops the client. Ops not committed yet may or may not be.
+func (c *Client) Close() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.closed = true
+  c.stop(ErrClosed)
+  return nil
+}
+
+// Client::Err():
+// Returns why the client stopped, or nil.
+func (c *Client) Err() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.err
+}
+
+func (c *Client) Text() string {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return string(utf16.Decode(c.doc))
+}
+
+// Client::Len():
+// Returns the length of the copy in UTF-16 code units, the unit of
+// positions.
+func (c *Client) Len() int {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return len(c.doc)
+}
+
+// Client::Revision():
+// Returns how many committed ops the copy includes.
+func (c *Client) Revision() uint64 {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.rev
+}
+
+// Client::Insert():
+// Inserts s at position pos of the copy and sends it to the replicas.
+func (c *Client) Insert(pos int, s string) error {
+  if s == "" {
+    return nil
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if err := c.checkPos(pos, len(c.doc)); err != nil {
+    return err
+  }
+  return c.submit(Op{Type: "Insert", Position: uint64(pos), Value: s})
+}
+
+// Client::Delete():
+// Deletes the character, one code point, at position pos of the copy
+// and sends it to the replicas.
+func (c *Client) Delete(pos int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if err := c.checkPos(pos, len(c.doc)-1); err != nil {
+    return err
+  }
+  n := 1
+  if pos+1 < len(c.doc) && isPair(c.doc[pos], c.doc[pos+1]) {
+    n = 2
+  }
+  value := string(utf16.Decode(c.doc[pos:pos+n]))
+  return c.submit(Op{Type: "Delete", Position: uint64(pos), Value: value})
+}
+
+// Client::checkPos():
+// Checks that pos is at most max and not inside a surrogate pair.
+// Holds c.mu.
+func (c *Client) checkPos(pos int, max int) error {
+  if c.err != nil {
+    return c.err
+  }
+  if pos < 0 || pos > max {
+    return ErrPosition
+  }
+  if pos > 0 && pos < len(c.doc) && isPair(c.doc[pos-1], c.doc[pos]) {
+    return ErrPosition
+  }
+  return nil
+}
+
+// Client::submit():
+// Applies op to the copy and queues it for the replicas. Holds c.mu.
+func (c *Client) submit(op Op) error {
+  op.ID, op.Version = c.cfg.ID, c.rev
+  c.doc = apply(c.doc, op)
+  c.pending = append(c.pending, op)
+  c.flush()
+  return nil
+}
+
+// Client::flush():
+// Sends the pending ops, up to MAX_BATCH of them in one message, once
+// those sent before are committed. Ops only go out one message at a
+// time so that a message refused is never followed by ops applying on
+// top of it. Between replicas the next one is handed the pending ops
+// instead. Holds c.mu.
+func (c *Client) flush() {
+  if c.ws == nil || c.sent > 0 || len(c.pending) == 0 {
+    return
+  }
+  n := len(c.pending)
+  if n > MAX_BATCH {
+    n = MAX_BATCH
+  }
+  ops := make([]Op, n)
+  for i, op := range c.pending[:n] {
+    op.ID, op.Version = c.cfg.ID, c.rev
+    ops[i] = op
+  }
+  c.ref++
+  var err error
+  if n == 1 {
+    err = writeFrame(c.ws, "op", opMsg{c.ref, ops[0]})
+  } else {
+    err = writeFrame(c.ws, "op batch", batchMsg{c.ref, ops})
+  }
+  c.sent = n
+  if err != nil {
+    // run() resumes elsewhere once reading fails too
+    c.log.Info("cannot send ops", "err", err)
+    c.ws.Close()
+  }
+}
+
+// Client::Sync():
+// Waits until the replicas have committed every op sent so far, for
+// at most timeout. Returns ErrOpsLost once if ops were dropped.
+func (c *Client) Sync(timeout time.Duration) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  expired := false
+  t := time.AfterFunc(timeout, func() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    expired = true
+    c.cond.Broadcast()
+  })
+  defer t.Stop()
+  for len(c.pending) > 0 && c.err == nil && !expired {
+    c.cond.Wait()
+  }
+  if c.lost {
+    c.lost = false
+    return ErrOpsLost
+  }
+  if c.err != nil {
+    return c.err
+  }
+  if len(c.pending) > 0 {
+    return ErrTimeout
+  }
+  return nil
+}
@@ -0,0 +1,335 @@
+package padclient
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is one end of an in-memory connection between a client and
+// a fake replica, which the test drives.
+type fakeConn struct {
+	in     chan []byte // frames to the client
+	out    chan []byte // frames from the client
+	closed chan bool
+	once   sync.Once
+}
+
+var errGone = errors.New("connection closed")
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{in: make(chan []byte, 100), out: make(chan []byte, 100),
+		closed: make(chan bool)}
+}
+
+func (fc *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-fc.in:
+		return 1, msg, nil
+	case <-fc.closed:
+		return 0, nil, errGone
+	}
+}
+
+func (fc *fakeConn) WriteMessage(t int, msg []byte) error {
+	select {
+	case <-fc.closed:
+		return errGone
+	default:
+	}
+	fc.out <- msg
+	return nil
+}
+
+func (fc *fakeConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (fc *fakeConn) Close() error {
+	fc.once.Do(func() { close(fc.closed) })
+	return nil
+}
+
+// fakeNet hands each connection dialed to a replica to the test.
+type fakeNet map[string]chan *fakeConn
+
+func (fn fakeNet) dial(addr string, token string) (wsConn, error) {
+	accept, ok := fn[addr]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	fc := newFakeConn()
+	accept <- fc
+	return fc, nil
+}
+
+func accept(t *testing.T, accept chan *fakeConn) *fakeConn {
+	select {
+	case fc := <-accept:
+		return fc
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no connection")
+	}
+	return nil
+}
+
+// expect reads the next frame from the client, which must be event,
+// into v.
+func expect(t *testing.T, fc *fakeConn, event string, v interface{}) {
+	select {
+	case msg := <-fc.out:
+		var f frame
+		if err := json.Unmarshal(msg, &f); err != nil || f.Event != event {
+			t.Fatalf("got %s, want %v", msg, event)
+		}
+		if v != nil {
+			if err := json.Unmarshal(f.Data, v); err != nil {
+				t.Fatalf("%s: %v", msg, err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %v from the client", event)
+	}
+}
+
+func send(fc *fakeConn, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	msg, _ := json.Marshal(frame{event, data})
+	fc.in <- msg
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v", what)
+}
+
+// openOn opens pad "pad" through the fake replica at net[addr], which
+// answers with pi.
+func openOn(t *testing.T, fn fakeNet, cfg Config, pi padInfo) (*Client, *fakeConn) {
+	var c *Client
+	var err error
+	done := make(chan bool)
+	go func() {
+		c, err = open(cfg, "pad", fn.dial)
+		done <- true
+	}()
+	fc := accept(t, fn[cfg.Replicas[0]])
+	expect(t, fc, "hello", nil)
+	var req openPadMsg
+	expect(t, fc, "open pad", &req)
+	if req.PadId != "pad" || req.Since != 0 || len(req.Pending) != 0 {
+		t.Fatalf("open pad: got %+v", req)
+	}
+	send(fc, "init_comt_op", pi)
+	<-done
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return c, fc
+}
+
+func TestEdit(t *testing.T) {
+	fn := fakeNet{"r0": make(chan *fakeConn, 1)}
+	var mu sync.Mutex
+	var seen []Op
+	cfg := Config{Replicas: []string{"r0"}, ID: 5, OnOp: func(op Op) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, op)
+	}}
+	c, fc := openOn(t, fn, cfg, padInfo{PadId: "pad", Version: 1,
+		Ops: []Op{{9, 0, "Insert", 0, "ab"}}})
+	defer c.Close()
+	if c.Text() != "ab" || c.Revision() != 1 {
+		t.Fatalf("opened at %q, %v", c.Text(), c.Revision())
+	}
+
+	if err := c.Insert(2, "c"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	var msg opMsg
+	expect(t, fc, "op", &msg)
+	want := Op{5, 1, "Insert", 2, "c"}
+	if msg.Ref != 1 || msg.Op != want {
+		t.Fatalf("sent %+v, want %+v", msg, want)
+	}
+
+	// another client's op, committed first, moves ours
+	send(fc, "op", Op{9, 1, "Insert", 0, "x"})
+	waitFor(t, "the other op", func() bool { return c.Revision() == 2 })
+	if c.Text() != "xabc" {
+		t.Fatalf("text %q, want %q", c.Text(), "xabc")
+	}
+	if err := c.Sync(10 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Sync before commit: got %v", err)
+	}
+	send(fc, "op", Op{5, 2, "Insert", 3, "c"})
+	if err := c.Sync(5 * time.Second); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if c.Text() != "xabc" || c.Revision() != 3 {
+		t.Fatalf("synced at %q, %v", c.Text(), c.Revision())
+	}
+	mu.Lock()
+	if len(seen) != 1 || seen[0] != (Op{9, 1, "Insert", 0, "x"}) {
+		t.Fatalf("OnOp got %+v", seen)
+	}
+	mu.Unlock()
+
+	// positions count UTF-16 code units
+	c.Insert(4, "😀")
+	expect(t, fc, "op", nil)
+	if c.Len() != 6 {
+		t.Fatalf("Len %v, want 6", c.Len())
+	}
+	if err := c.Delete(5); err != ErrPosition {
+		t.Fatalf("Delete inside a pair: got %v", err)
+	}
+	if err := c.Insert(7, "y"); err != ErrPosition {
+		t.Fatalf("Insert past the end: got %v", err)
+	}
+	// sent once the op before it is committed
+	c.Delete(4)
+	send(fc, "op", Op{5, 3, "Insert", 4, "😀"})
+	expect(t, fc, "op", &msg)
+	if msg.Op.Value != "😀" || msg.Op.Version != 4 || c.Text() != "xabc" {
+		t.Fatalf("deleted %+v, leaving %q", msg.Op, c.Text())
+	}
+
+	// an op the replica refuses stops the client
+	send(fc, "error", errorMsg{"read_only", "read-only access", 3})
+	waitFor(t, "the error", func() bool { return c.Err() != nil })
+	if se, ok := c.Sync(time.Second).(*ServerError); !ok || se.Code != "read_only" {
+		t.Fatalf("Sync after error: got %v", c.Err())
+	}
+	if err := c.Insert(0, "z"); c.Err() == nil || err != c.Err() {
+		t.Fatalf("Insert after error: got %v", err)
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	fn := fakeNet{"r0": make(chan *fakeConn, 1)}
+	cfg := Config{Replicas: []string{"r0"}, ID: 5}
+	c, fc := openOn(t, fn, cfg, padInfo{PadId: "pad"})
+	defer c.Close()
+
+	c.Insert(0, "a")
+	expect(t, fc, "op", nil)
+	c.Insert(1, "b")
+	c.Insert(2, "c")
+	// the first op is refused, and sent again with those queued since
+	send(fc, "error", errorMsg{"limit_exceeded",
+		"rate limit exceeded: at most 50 ops per second", 1})
+	var msg batchMsg
+	expect(t, fc, "op batch", &msg)
+	want := []Op{{5, 0, "Insert", 0, "a"}, {5, 0, "Insert", 1, "b"},
+		{5, 0, "Insert", 2, "c"}}
+	if c.Err() != nil || msg.Ref != 2 || len(msg.Ops) != 3 ||
+		msg.Ops[0] != want[0] || msg.Ops[1] != want[1] || msg.Ops[2] != want[2] {
+		t.Fatalf("sent %+v after the refusal, err %v", msg, c.Err())
+	}
+	for i, op := range want {
+		op.Version += uint64(i)
+		send(fc, "op", op)
+	}
+	if err := c.Sync(5 * time.Second); err != nil || c.Text() != "abc" {
+		t.Fatalf("Sync: %v, text %q", err, c.Text())
+	}
+
+	// other limits are not waited out
+	c.Insert(3, strings.Repeat("d", 2000))
+	expect(t, fc, "op", nil)
+	send(fc, "error", errorMsg{"limit_exceeded",
+		"op too large: Value is limited to 1024 UTF-16 code units", 3})
+	waitFor(t, "the error", func() bool { return c.Err() != nil })
+}
+
+func TestFailover(t *testing.T) {
+	fn := fakeNet{"r0": make(chan *fakeConn, 1), "r1": make(chan *fakeConn, 1)}
+	cfg := Config{Replicas: []string{"r0", "down", "r1"}, ID: 5}
+	c, fc := openOn(t, fn, cfg, padInfo{PadId: "pad"})
+	defer c.Close()
+
+	c.Insert(0, "a")
+	expect(t, fc, "op", nil)
+	fc.Close()
+
+	// the client resumes on r1, handing over its pending op
+	fc = accept(t, fn["r1"])
+	expect(t, fc, "hello", nil)
+	var req openPadMsg
+	expect(t, fc, "open pad", &req)
+	want := Op{5, 0, "Insert", 0, "a"}
+	if req.Since != 0 || len(req.Pending) != 1 || req.Pending[0] != want {
+		t.Fatalf("resumed with %+v", req)
+	}
+	// somebody else got in first
+	send(fc, "op", Op{9, 0, "Insert", 0, "z"}) // also in init_comt_op
+	send(fc, "init_comt_op", padInfo{PadId: "pad", Version: 1,
+		Ops: []Op{{9, 0, "Insert", 0, "z"}}})
+	send(fc, "op", Op{9, 0, "Insert", 0, "z"})
+	send(fc, "op", Op{5, 1, "Insert", 1, "a"})
+	if err := c.Sync(5 * time.Second); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if c.Text() != "za" || c.Revision() != 2 {
+		t.Fatalf("resumed at %q, %v", c.Text(), c.Revision())
+	}
+
+	// a replica that has compacted the revision drops pending ops
+	c.Insert(2, "b")
+	expect(t, fc, "op", nil)
+	fc.Close()
+	fc = accept(t, fn["r0"])
+	expect(t, fc, "hello", nil)
+	expect(t, fc, "open pad", nil)
+	send(fc, "init_comt_op", padInfo{PadId: "pad", Version: 8, Base: 8,
+		Snapshot: true, Text: "compacted"})
+	if err := c.Sync(5 * time.Second); err != ErrOpsLost {
+		t.Fatalf("Sync: got %v, want %v", err, ErrOpsLost)
+	}
+	if c.Text() != "compacted" || c.Revision() != 8 {
+		t.Fatalf("snapshot at %q, %v", c.Text(), c.Revision())
+	}
+	if err := c.Sync(time.Second); err != nil {
+		t.Fatalf("second Sync: %v", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	cases := []struct {
+		op1, op2 Op
+		first    bool
+		want     Op
+	}{
+		{Op{Type: "Insert", Position: 2, Value: "a"},
+			Op{Type: "Insert", Position: 2, Value: "😀"}, true,
+			Op{Type: "Insert", Position: 4, Value: "a"}},
+		{Op{Type: "Insert", Position: 2, Value: "a"},
+			Op{Type: "Insert", Position: 2, Value: "b"}, false,
+			Op{Type: "Insert", Position: 2, Value: "a"}},
+		{Op{Type: "Insert", Position: 3, Value: "a"},
+			Op{Type: "Delete", Position: 2, Value: "😀"}, true,
+			Op{Type: "Insert", Position: 2, Value: "a"}},
+		{Op{Type: "Delete", Position: 3, Value: "x"},
+			Op{Type: "Delete", Position: 2, Value: "😀"}, true,
+			Op{Type: "NoOp", Position: 3, Value: "x"}},
+		{Op{Type: "Delete", Position: 3, Value: "x"},
+			Op{Type: "Insert", Position: 3, Value: "y"}, false,
+			Op{Type: "Delete", Position: 4, Value: "x"}},
+	}
+	for _, c := range cases {
+		got := c.op1
+		transform(&got, c.op2, c.first)
+		if got != c.want {
+			t.Fatalf("%+v past %+v: got %+v, want %+v", c.op1, c.op2, got,
+				c.want)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+//
+// padctl talks to the replicas' HTTP API:
+//
+//   padctl list                 pads, with their revision and size
+//   padctl cat <pad>            the text of a pad
+//   padctl tail [-since N] <pad>
+//                               committed ops, as they are committed
+//   padctl export <pad> <file>  the text of a pad into file (- for stdout)
+//   padctl import <pad> <file>  replaces the text of a pad with file's
+//   padctl status               commit point and log bounds of each replica
+//   padctl delete <pad>         deletes a pad on every replica, as its
+//                               owner; needs authentication enabled
+//
+// Requests go to the first replica of -servers that answers.
+//
+
+import (
+  "os"
+  "fmt"
+  "flag"
+  "time"
+  "bufio"
+  "bytes"
+  "errors"
+  "io"
+  "math/big"
+  "crypto/rand"
+  "net/url"
+  "net/http"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "unicode/utf16"
+  "unicode/utf8"
+  "encoding/json"
+)
+
+const API_PREFIX = "/api/pads/"
+
+// The messages of the API used, as in the server's protocol.go and
+// httpapi.go.
+type Op struct {
+  ID       int64
+  Version  uint64
+  Type     string
+  Position uint64
+  Value    string
+}
+
+type batchMsg struct {
+  Ref uint64
+  Ops []Op
+}
+
+type ackMsg struct {
+  Ref uint64
+  Ops []Op
+}
+
+type padInfo struct {
+  PadId    string
+  Version  uint64
+  Base     uint64
+  Snapshot bool
+  Text     string
+  Ops      []Op
+}
+
+type padSummary struct {
+  PadId    string
+  Revision uint64
+  Size     int
+}
+
+type errorMsg struct {
+  Code    string
+  Message string
+}
+
+type replicaStatus struct {
+  Replica     int
+  CommitPoint int
+  Max         int
+  MaxKnown    int
+  Min         int
+  MajorityUp  bool
+}
+
+// apiError is an error a replica answered with.
+type apiError struct {
+  Status int
+  errorMsg
+}
+
+func (e *apiError) Error() string {
+  if e.Code == "" {
+    return fmt.Sprintf("HTTP %v", e.Status)
+  }
+  return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+type ctl struct {
+  servers []string
+  token   string
+  out     io.Writer
+}
+
+func usage() {
+  fmt.Fprintf(os.Stderr, "usage: padctl [flags] <command> [args]\n\n" +
+    "commands:\n" +
+    "  list                  list pads\n" +
+    "  cat <pad>             print the text of a pad\n" +
+    "  tail [-since N] <pad> print committed ops as they are committed\n" +
+    "  export <pad> <file>   write the text of a pad to file, - for stdout\n" +
+    "  import <pad> <file>   replace the text of a pad with file's\n" +
+    "  status                show the state of each replica\n" +
+    "  delete <pad>          delete a pad on every replica\n\nflags:\n")
+  flag.PrintDefaults()
+}
+
+func main() {
+  servers := flag.String("servers", "localhost:8080,localhost:8081,localhost:8082",
+    "comma-separated host:port of the replicas")
+  token := flag.String("token", "",
+    "authentication token, if the replicas require one")
+  flag.Usage = usage
+  flag.Parse()
+  if flag.NArg() < 1 {
+    usage()
+    os.Exit(2)
+  }
+
+  c := &ctl{strings.Split(*servers, ","), *token, os.Stdout}
+  if err := c.run(flag.Arg(0), flag.Args()[1:]); err != nil {
+    fmt.Fprintf(os.Stderr, "padctl: %v\n", err)
+    os.Exit(1)
+  }
+}
+
+// ctl::run():
+// Runs command cmd with arguments args.
+func (c *ctl) run(cmd string, args []string) error {
+  fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+  since := fs.Int64("since", -1, "revision to start at; -1 for the latest")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  args = fs.Args()
+  nargs := map[string]int{"list": 0, "status": 0, "cat": 1, "tail": 1,
+                          "delete": 1, "export": 2, "import": 2}
+  n, ok := nargs[cmd]
+  if !ok {
+    return fmt.Errorf("unknown command %q", cmd)
+  }
+  if len(args) != n {
+    return fmt.Errorf("%v takes %v arguments", cmd, n)
+  }
+
+  switch cmd {
+  case "list":
+    return c.list()
+  case "status":
+    return c.status()
+  case "cat":
+    return c.export(args[0], "-")
+  case "tail":
+    return c.tail(args[0], *since)
+  case "delete":
+    return c.delete(args[0])
+  case "export":
+    return c.export(args[0], args[1])
+  case "import":
+    return c.importFile(args[0], args[1])
+  }
+  return nil
+}
+
+// ctl::do():
+// Sends a request to the first replica that answers it. A 2xx answer
+// is returned for the caller to close; others are returned as errors.
+func (c *ctl) do(method string, path string, body []byte,
+                 header http.Header) (*http.Response, error) {
+  var err error
+  for _, server := range c.servers {
+    var req *http.Request
+    req, err = http.NewRequest(method, "http://"+server+path,
+                               bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+    for k, v := range header {
+      req.Header[k] = v
+    }
+    if c.token != "" {
+      req.Header.Set("Authorization", "Bearer "+c.token)
+    }
+    var resp *http.Response
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil {
+      // try the next replica
+      continue
+    }
+    if resp.StatusCode/100 == 2 {
+      return resp, nil
+    }
+    defer resp.Body.Close()
+    ae := &apiError{Status: resp.StatusCode}
+    json.NewDecoder(resp.Body).Decode(&ae.errorMsg)
+    return nil, ae
+  }
+  return nil, err
+}
+
+func (c *ctl) getJSON(path string, v interface{}) error {
+  resp, err := c.do("GET", path, nil, nil)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func padPath(pad string) string {
+  return API_PREFIX + url.PathEscape(pad)
+}
+
+func (c *ctl) list() error {
+  var pads []padSummary
+  if err := c.getJSON(API_PREFIX, &pads); err != nil {
+    return err
+  }
+  tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+  fmt.Fprintf(tw, "PAD\tREVISION\tSIZE\n")
+  for _, p := range pads {
+    fmt.Fprintf(tw, "%v\t%v\t%v\n", p.PadId, p.Revision, p.Size)
+  }
+  return tw.Flush()
+}
+
+// ctl::status():
+// Asks every replica, not only the first that answers.
+func (c *ctl) status() error {
+  tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+  fmt.Fprintf(tw, "SERVER\tREPLICA\tCOMMIT\tMAX\tMAXKNOWN\tMIN\tMAJORITY\n")
+  failed := 0
+  for _, server := range c.servers {
+    one := &ctl{[]string{server}, c.token, c.out}
+    var st replicaStatus
+    if err := one.getJSON("/status", &st); err != nil {
+      fmt.Fprintf(tw, "%v\t-\t%v\n", server, err)
+      failed++
+      continue
+    }
+    majority := "no"
+    if st.MajorityUp {
+      majority = "yes"
+    }
+    fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", server, st.Replica,
+                st.CommitPoint, st.Max, st.MaxKnown, st.Min, majority)
+  }
+  tw.Flush()
+  if failed == len(c.servers) {
+    return errors.New("no replica answered")
+  }
+  return nil
+}
+
+// ctl::text():
+// Returns the text of pad and the revision it is at.
+func (c *ctl) text(pad string) (string, uint64, error) {
+  resp, err := c.do("GET", padPath(pad)+"/text", nil, nil)
+  if err != nil {
+    return "", 0, err
+  }
+  defer resp.Body.Close()
+  text, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return "", 0, err
+  }
+  rev, err := strconv.ParseUint(resp.Header.Get("X-Pad-Revision"), 10, 64)
+  if err != nil {
+    return "", 0, errors.New("no revision in the answer")
+  }
+  return string(text), rev, nil
+}
+
+func (c *ctl) export(pad string, file string) error {
+  text, _, err := c.text(pad)
+  if err != nil {
+    return err
+  }
+  if file == "-" {
+    _, err = io.WriteString(c.out, text)
+    return err
+  }
+  return os.WriteFile(file, []byte(text), 0644)
+}
+
+func (c *ctl) delete(pad string) error {
+  resp, err := c.do("DELETE", padPath(pad), nil, nil)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  return nil
+}
+
+// ctl::importFile():
+// Replaces the text of pad with the contents of file, through ops: a
+// delete per character there is, then inserts of the new text in
+// chunks. The ops go as a single batch, so the replace is committed
+// whole or not at all, and edits made meanwhile are merged with it as
+// with any batch. Replicas refuse batches longer than their -max-batch.
+func (c *ctl) importFile(pad string, file string) error {
+  data, err := os.ReadFile(file)
+  if err != nil {
+    return err
+  }
+  if !utf8.Valid(data) {
+    return fmt.Errorf("%v is not UTF-8", file)
+  }
+  old, rev, err := c.text(pad)
+  if err != nil {
+    return err
+  }
+  id, _ := rand.Int(rand.Reader, big.NewInt(int64(1) << 62))
+  ops := importOps(id.Int64()+1, old, string(data))
+  if len(ops) == 0 {
+    return nil
+  }
+  for i := range ops {
+    ops[i].Version = rev
+  }
+  if _, err := c.post(pad, ops); err != nil {
+    return fmt.Errorf("%v unchanged: %v", pad, err)
+  }
+  return nil
+}
+
+// importOps()
+// Returns the ops of client id that turn old into text, each applying
+// on top of the ones before it.
+func importOps(id int64, old string, text string) []Op {
+  var ops []Op
+  for range old {
+    ops = append(ops, Op{ID: id, Type: "Delete", Position: 0})
+  }
+  // replicas limit Values to 1024 code units by default, which 1024
+  // bytes never exceed
+  const maxChunk = 1 << 10
+  pos := uint64(0)
+  for len(text) > 0 {
+    n := len(text)
+    if n > maxChunk {
+      n = maxChunk
+      for !utf8.RuneStart(text[n]) {
+        n--
+      }
+    }
+    chunk := text[:n]
+    ops = append(ops, Op{ID: id, Type: "Insert", Position: pos,
+                         Value: chunk})
+    pos += uint64(len(utf16.Encode([]rune(chunk))))
+    text = text[n:]
+  }
+  return ops
+}
+
+// ctl::post():
+// Commits a batch, waiting out the rate limit. Other limits are not
+// waited for, as the same batch would only be refused again.
+func (c *ctl) post(pad string, ops []Op) (ackMsg, error) {
+  var ack ackMsg
+  body, _ := json.Marshal(batchMsg{Ops: ops})
+  header := http.Header{"Content-Type": {"application/json"}}
+  for wait := time.Second; ; wait *= 2 {
+    resp, err := c.do("POST", padPath(pad)+"/ops", body, header)
+    if ae, ok := err.(*apiError); ok && ae.Status == http.StatusTooManyRequests &&
+       strings.HasPrefix(ae.Message, "rate limit") && wait <= 16*time.Second {
+      time.Sleep(wait)
+      continue
+    }
+    if err != nil {
+      return ack, err
+    }
+    defer resp.Body.Close()
+    err = json.NewDecoder(resp.Body).Decode(&ack)
+    if err == nil && len(ack.Ops) != len(ops) {
+      err = errors.New("short acknowledgement")
+    }
+    return ack, err
+  }
+}
+
+// ctl::tail():
+// Prints the ops committed to pad from revision since on, or from the
+// latest if since is negative, following the event stream of each
+// replica in turn until none answers.
+func (c *ctl) tail(pad string, since int64) error {
+  if since < 0 {
+    _, rev, err := c.text(pad)
+    if err != nil {
+      return err
+    }
+    since = int64(rev)
+  }
+  next := uint64(since)
+  header := http.Header{"Accept": {"text/event-stream"}}
+  for {
+    header.Set("Last-Event-ID", strconv.FormatUint(next, 10))
+    resp, err := c.do("GET", padPath(pad)+"/events", nil, header)
+    if err != nil {
+      return err
+    }
+    done, err := c.follow(resp.Body, &next)
+    resp.Body.Close()
+    if done {
+      return err
+    }
+    fmt.Fprintf(os.Stderr, "padctl: stream lost, resuming at %v: %v\n",
+                next, err)
+    time.Sleep(time.Second)
+  }
+}
+
+// ctl::follow():
+// Prints the ops of an event stream, keeping next the revision after
+// the last one. Returns whether the pad is gone.
+func (c *ctl) follow(stream io.Reader, next *uint64) (bool, error) {
+  rd := bufio.NewReader(stream)
+  event, data := "", ""
+  for {
+    line, err := rd.ReadString('\n')
+    if err != nil {
+      return false, err
+    }
+    line = strings.TrimRight(line, "\r\n")
+    if strings.HasPrefix(line, "event: ") {
+      event = line[len("event: "):]
+    } else if strings.HasPrefix(line, "data: ") {
+      data = line[len("data: "):]
+    }
+    if line != "" {
+      // a blank line ends an event
+      continue
+    }
+
+    switch event {
+    case "init_comt_op":
+      var pi padInfo
+      if err := json.Unmarshal([]byte(data), &pi); err != nil {
+        return false, err
+      }
+      if pi.Snapshot {
+        fmt.Fprintf(c.out, "rev %v: text %q\n", pi.Base, pi.Text)
+      }
+      for _, op := range pi.Ops {
+        c.printOp(op)
+      }
+      *next = pi.Version
+    case "op":
+      var op Op
+      if err := json.Unmarshal([]byte(data), &op); err != nil {
+        return false, err
+      }
+      c.printOp(op)
+      *next = op.Version + 1
+    case "pad deleted":
+      fmt.Fprintf(c.out, "pad deleted\n")
+      return true, nil
+    }
+    event, data = "", ""
+  }
+}
+
+func (c *ctl) printOp(op Op) {
+  fmt.Fprintf(c.out, "rev %v: client %v %v at %v %q\n", op.Version, op.ID,
+              op.Type, op.Position, op.Value)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportOps(t *testing.T) {
+	text := "😀" + strings.Repeat("a", 1<<10)
+	ops := importOps(7, "xé", text)
+	want := []Op{
+		{7, 0, "Delete", 0, ""},
+		{7, 0, "Delete", 0, ""},
+		{7, 0, "Insert", 0, "😀" + strings.Repeat("a", 1<<10-4)},
+		{7, 0, "Insert", 1<<10 - 2, "aaaa"},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("got %+v", ops)
+	}
+}
+
+// fakeReplica serves the pad API for one pad, recording the batches
+// posted to it. It refuses batches of more than 4 ops.
+func fakeReplica(t *testing.T, batches *[]batchMsg) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/pads/a/b/text":
+			w.Header().Set("X-Pad-Revision", "4")
+			fmt.Fprint(w, "ab")
+		case "POST /api/pads/a/b/ops":
+			var b batchMsg
+			json.NewDecoder(r.Body).Decode(&b)
+			*batches = append(*batches, b)
+			if len(b.Ops) > 4 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(errorMsg{"limit",
+					"batch too large: at most 4 ops"})
+				return
+			}
+			committed := append([]Op(nil), b.Ops...)
+			for i := range committed {
+				committed[i].Version += uint64(i)
+			}
+			json.NewEncoder(w).Encode(ackMsg{b.Ref, committed})
+		case "GET /api/pads/a/b/events":
+			if r.Header.Get("Last-Event-ID") != "4" {
+				t.Errorf("events from %q", r.Header.Get("Last-Event-ID"))
+			}
+			fmt.Fprint(w, "id: 4\nevent: init_comt_op\n"+
+				`data: {"PadId":"a/b","Version":4,"Ops":[]}`+"\n\n"+
+				": ping\n\n"+
+				"id: 5\nevent: op\n"+
+				`data: {"ID":3,"Version":4,"Type":"Insert","Position":2,"Value":"c"}`+"\n\n"+
+				"id: 5\nevent: pad deleted\ndata: {\"PadId\":\"a/b\"}\n\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errorMsg{"unknown_pad", "no such pad"})
+		}
+	}))
+}
+
+func TestCommands(t *testing.T) {
+	var batches []batchMsg
+	srv := fakeReplica(t, &batches)
+	defer srv.Close()
+	var out bytes.Buffer
+	// the first replica is down
+	c := &ctl{[]string{"localhost:1", strings.TrimPrefix(srv.URL, "http://")},
+		"", &out}
+
+	if err := c.run("cat", []string{"a/b"}); err != nil || out.String() != "ab" {
+		t.Fatalf("cat: got %q, %v", out.String(), err)
+	}
+
+	file := filepath.Join(t.TempDir(), "text")
+	os.WriteFile(file, []byte(strings.Repeat("x", 150)), 0644)
+	if err := c.run("import", []string{"a/b", file}); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if len(batches) != 1 || len(batches[0].Ops) != 3 ||
+		batches[0].Ops[2].Version != 4 {
+		t.Fatalf("import posted %+v", batches)
+	}
+	// too large a batch is refused whole, and not sent again
+	batches = nil
+	os.WriteFile(file, []byte(strings.Repeat("x", 4<<10)), 0644)
+	err := c.run("import", []string{"a/b", file})
+	if err == nil || !strings.Contains(err.Error(), "a/b unchanged") ||
+		len(batches) != 1 || len(batches[0].Ops) != 6 {
+		t.Fatalf("import of a large file: got %v after %v batches", err,
+			len(batches))
+	}
+
+	out.Reset()
+	if err := c.run("tail", []string{"a/b"}); err != nil {
+		t.Fatalf("tail: %v", err)
+	}
+	want := "rev 4: client 3 Insert at 2 \"c\"\npad deleted\n"
+	if out.String() != want {
+		t.Fatalf("tail: got %q, want %q", out.String(), want)
+	}
+
+	err = c.run("cat", []string{"none"})
+	if ae, ok := err.(*apiError); !ok || ae.Code != "unknown_pad" {
+		t.Fatalf("cat of a missing pad: got %v", err)
+	}
+	if err := c.run("cat", nil); err == nil {
+		t.Fatalf("cat without a pad succeeded")
+	}
+}
@@ -0,0 +1,178 @@
+package paxos
+
+import (
+  "context"
+  "net"
+  "net/rpc"
+  "sync"
+  "time"
+)
+
+// pooledTransport keeps one long-lived connection to every peer and
+// multiplexes concurrent messages over it, instead of dialing for every
+// message like rpcTransport. A connection that fails or times out is
+// dropped and redialed by the next message to the same peer. It
+// receives messages exactly like rpcTransport.
+type pooledTransport struct {
+  rpcTransport
+  timeout time.Duration
+  mu      sync.Mutex
+  conns   map[string]*peerConn
+}
+
+type peerConn struct {
+  mu sync.Mutex // serializes dials
+  c  *rpc.Client
+}
+
+// NewPooledRPCTransport returns a transport speaking the same protocol
+// as NewRPCTransport(nil), over persistent connections. A message that
+// gets no reply within timeout counts as lost; zero means no timeout.
+func NewPooledRPCTransport(timeout time.Duration) Transport {
+  t := &pooledTransport{}
+  t.timeout = timeout
+  t.conns = make(map[string]*peerConn)
+  return t
+}
+
+func (t *pooledTransport) Prepare(ctx context.Context, peer string,
+                                  args *PrepareArgs, reply *PrepareReply) bool {
+  r := PrepareReply{}
+  ok := t.call(ctx, peer, "Paxos.Prepare", args, &r)
+  if ok {
+    *reply = r
+  }
+  return ok
+}
+
+func (t *pooledTransport) Accept(ctx context.Context, peer string,
+                                 args *AcceptArgs, reply *AcceptReply) bool {
+  r := AcceptReply{}
+  ok := t.call(ctx, peer, "Paxos.Accept", args, &r)
+  if ok {
+    *reply = r
+  }
+  return ok
+}
+
+func (t *pooledTransport) Decided(ctx context.Context, peer string,
+                                  args *DecidedArgs, reply *DecidedReply) bool {
+  r := DecidedReply{}
+  ok := t.call(ctx, peer, "Paxos.Decided", args, &r)
+  if ok {
+    *reply = r
+  }
+  return ok
+}
+
+func (t *pooledTransport) Ping(ctx context.Context, peer string,
+                               args *PingArgs, reply *PingReply) bool {
+  r := PingReply{}
+  ok := t.call(ctx, peer, "Paxos.Ping", args, &r)
+  if ok {
+    *reply = r
+  }
+  return ok
+}
+
+func (t *pooledTransport) Close() error {
+  t.mu.Lock()
+  for peer, pc := range t.conns {
+    pc.mu.Lock()
+    if pc.c != nil {
+      pc.c.Close()
+      pc.c = nil
+    }
+    pc.mu.Unlock()
+    delete(t.conns, peer)
+  }
+  t.mu.Unlock()
+  return t.rpcTransport.Close()
+}
+
+// pooledTransport::client():
+// Returns the connection to peer, dialing it if there is none. The
+// dial gives up when ctx is done.
+func (t *pooledTransport) client(ctx context.Context, peer string) *rpc.Client {
+  t.mu.Lock()
+  pc, ok := t.conns[peer]
+  if !ok {
+    pc = &peerConn{}
+    t.conns[peer] = pc
+  }
+  t.mu.Unlock()
+
+  pc.mu.Lock()
+  defer pc.mu.Unlock()
+  if pc.c == nil {
+    d := net.Dialer{Timeout: t.timeout}
+    conn, err := d.DialContext(ctx, "unix", peer)
+    if err != nil {
+      t.px.log.Debug("dial failed", "peer", peer, "err", err)
+      return nil
+    }
+    pc.c = rpc.NewClient(conn)
+  }
+  return pc.c
+}
+
+// pooledTransport::drop():
+// Closes c if it is still the connection to peer, so that the next
+// message redials.
+func (t *pooledTransport) drop(peer string, c *rpc.Client) {
+  t.mu.Lock()
+  pc, ok := t.conns[peer]
+  t.mu.Unlock()
+  if !ok {
+    return
+  }
+  pc.mu.Lock()
+  if pc.c == c {
+    pc.c = nil
+    c.Close()
+  }
+  pc.mu.Unlock()
+}
+
+// pooledTransport::call():
+// Sends a message over the connection to peer. Like call(), it may
+// give up on a reply that is later decoded into reply anyway.
+func (t *pooledTransport) call(ctx context.Context, peer string, name string,
+                               args interface{}, reply interface{}) bool {
+  c := t.client(ctx, peer)
+  if c == nil {
+    return false
+  }
+
+  var expired <-chan time.Time
+  if t.timeout > 0 {
+    timer := time.NewTimer(t.timeout)
+    defer timer.Stop()
+    expired = timer.C
+  }
+
+  rc := c.Go(name, args, reply, make(chan *rpc.Call, 1))
+  select {
+  case <-rc.Done:
+    if rc.Error == nil {
+      return true
+    }
+    // a ServerError came back over a healthy connection
+    if _, ok := rc.Error.(rpc.ServerError); !ok {
+      t.drop(peer, c)
+    }
+    t.px.log.Debug("rpc failed", "peer", peer, "rpc", name, "err", rc.Error)
+    return false
+  case <-expired:
+    // the connection may be wedged; dropping it also fails any other
+    // message waiting on it
+    t.drop(peer, c)
+    t.px.log.Debug("rpc timed out", "peer", peer, "rpc", name)
+    return false
+  case <-ctx.Done():
+    // the connection is shared, so leave it be; the reply will be
+    // discarded when it arrives
+    t.px.log.Debug("rpc abandoned", "peer", peer, "rpc", name)
+    return false
+  }
+}
@@ -0,0 +1,269 @@
+package paxos
+
+//
+// SimNetwork is an in-process network that misbehaves on purpose, for
+// tests. Every message is delayed by a random time, so messages are
+// reordered, and may be lost, have its reply lost, or be delivered
+// twice. Peers can be split into partitions.
+//
+// The fate of a message is drawn from a random source of its own,
+// seeded from the network's seed, its link and the message itself, so
+// the same message on the same link meets the same fate on every run
+// with that seed, whichever order the peers' goroutines send in. A
+// failing schedule is replayed from its seed; what the scheduler still
+// decides is which messages are in flight when the test partitions the
+// network, and so which messages the peers send at all.
+//
+// nw := paxos.NewSimNetwork(seed, paxos.SimConfig{MaxDelay: time.Millisecond, Loss: 0.1})
+// px = paxos.Make(peers, me, nw.Transport())
+// nw.Partition([]string{peers[0], peers[1]}, []string{peers[2]})
+// nw.Heal()
+//
+
+import (
+  "context"
+  "fmt"
+  "hash/fnv"
+  "sync"
+  "time"
+)
+
+type SimConfig struct {
+  MinDelay time.Duration // every message takes between MinDelay
+  MaxDelay time.Duration // and MaxDelay to arrive
+  Loss     float64       // probability that a message is dropped
+  Dup      float64       // probability that a message is handled twice
+}
+
+type SimNetwork struct {
+  mu    sync.Mutex
+  seed  int64
+  cfg   SimConfig
+  peers map[string]*Paxos
+  group map[string]int    // partition of each address; absent means 0
+  sent  map[string]int    // how often each message was sent
+  trace []string          // the fate of every message, if tracing
+  tracing bool
+}
+
+func NewSimNetwork(seed int64, cfg SimConfig) *SimNetwork {
+  nw := &SimNetwork{}
+  nw.seed = seed
+  nw.cfg = cfg
+  nw.peers = make(map[string]*Paxos)
+  nw.group = make(map[string]int)
+  nw.sent = make(map[string]int)
+  return nw
+}
+
+// SimNetwork::Transport():
+// Returns a transport for one more peer on this network.
+func (nw *SimNetwork) Transport() Transport {
+  return &simTransport{nw: nw}
+}
+
+func (nw *SimNetwork) SetConfig(cfg SimConfig) {
+  nw.mu.Lock()
+  nw.cfg = cfg
+  nw.mu.Unlock()
+}
+
+// SimNetwork::Partition():
+// Lets peers talk only to peers in the same group. Peers that are in
+// no group can only talk to each other.
+func (nw *SimNetwork) Partition(groups ...[]string) {
+  nw.mu.Lock()
+  defer nw.mu.Unlock()
+  nw.group = make(map[string]int)
+  for i, g := range groups {
+    for _, addr := range g {
+      nw.group[addr] = i + 1
+    }
+  }
+}
+
+// SimNetwork::Heal():
+// Undoes Partition().
+func (nw *SimNetwork) Heal() {
+  nw.Partition()
+}
+
+// SimNetwork::Trace():
+// Starts recording the fate of every message, and returns what was
+// recorded since the last call, one line per message.
+func (nw *SimNetwork) Trace() []string {
+  nw.mu.Lock()
+  defer nw.mu.Unlock()
+  ret := nw.trace
+  nw.trace = nil
+  nw.tracing = true
+  return ret
+}
+
+// What happens to one message.
+type simFate struct {
+  px        *Paxos        // nil if the message is lost
+  delay     time.Duration
+  loseReply bool
+  dupDelay  time.Duration // when to handle it again; zero for never
+}
+
+// SimNetwork::route():
+// Decides the fate of message msg from src to addr. A message sent
+// again, e.g. a Decided for an instance that is decided again, counts
+// as another message.
+func (nw *SimNetwork) route(src string, addr string, msg string) simFate {
+  nw.mu.Lock()
+  defer nw.mu.Unlock()
+  key := src + " -> " + addr + " " + msg
+  nw.sent[key]++
+  rng := newSimRand(nw.seed, fmt.Sprintf("%v #%v", key, nw.sent[key]))
+
+  f := simFate{}
+  f.delay = rng.delay(nw.cfg)
+  lost := rng.float64() < nw.cfg.Loss
+  f.loseReply = rng.float64() < nw.cfg.Loss
+  if rng.float64() < nw.cfg.Dup {
+    f.dupDelay = rng.delay(nw.cfg) + 1
+  }
+  if nw.tracing {
+    nw.trace = append(nw.trace, fmt.Sprintf("%v #%v: delay %v lost %v " +
+                                            "reply lost %v dup %v", key,
+                                            nw.sent[key], f.delay, lost,
+                                            f.loseReply, f.dupDelay))
+  }
+
+  px := nw.peers[addr]
+  if nw.group[src] != nw.group[addr] || lost || px == nil || px.isdead() {
+    return simFate{delay: f.delay}
+  }
+  f.px = px
+  return f
+}
+
+// simRand is a splitmix64 generator, cheap enough to seed one for
+// every message.
+type simRand uint64
+
+func newSimRand(seed int64, s string) *simRand {
+  h := fnv.New64a()
+  fmt.Fprintf(h, "%v %v", seed, s)
+  r := simRand(h.Sum64())
+  return &r
+}
+
+func (r *simRand) next() uint64 {
+  *r += 0x9e3779b97f4a7c15
+  z := uint64(*r)
+  z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+  z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+  return z ^ (z >> 31)
+}
+
+// a float64 in [0, 1)
+func (r *simRand) float64() float64 {
+  return float64(r.next() >> 11) / (1 << 53)
+}
+
+func (r *simRand) delay(cfg SimConfig) time.Duration {
+  d := cfg.MinDelay
+  if cfg.MaxDelay > cfg.MinDelay {
+    d += time.Duration(r.next() % uint64(cfg.MaxDelay - cfg.MinDelay))
+  }
+  return d
+}
+
+type simTransport struct {
+  nw   *SimNetwork
+  addr string
+}
+
+func (t *simTransport) Listen(addr string, px *Paxos) error {
+  t.nw.mu.Lock()
+  defer t.nw.mu.Unlock()
+  if _, ok := t.nw.peers[addr]; ok {
+    return fmt.Errorf("SimNetwork: %v is already listening", addr)
+  }
+  t.addr = addr
+  t.nw.peers[addr] = px
+  return nil
+}
+
+func (t *simTransport) Prepare(ctx context.Context, peer string,
+                               args *PrepareArgs, reply *PrepareReply) bool {
+  msg := fmt.Sprintf("Prepare %v %v", args.Seq, args.N)
+  return t.deliver(ctx, peer, msg, func(px *Paxos, dup bool) error {
+    if dup {
+      return px.Prepare(args, &PrepareReply{})
+    }
+    return px.Prepare(args, reply)
+  })
+}
+
+func (t *simTransport) Accept(ctx context.Context, peer string,
+                              args *AcceptArgs, reply *AcceptReply) bool {
+  msg := fmt.Sprintf("Accept %v %v %v", args.Seq, args.N, args.V)
+  return t.deliver(ctx, peer, msg, func(px *Paxos, dup bool) error {
+    if dup {
+      return px.Accept(args, &AcceptReply{})
+    }
+    return px.Accept(args, reply)
+  })
+}
+
+func (t *simTransport) Decided(ctx context.Context, peer string,
+                               args *DecidedArgs, reply *DecidedReply) bool {
+  msg := fmt.Sprintf("Decided %v %v", args.Seq, args.V)
+  return t.deliver(ctx, peer, msg, func(px *Paxos, dup bool) error {
+    if dup {
+      return px.Decided(args, &DecidedReply{})
+    }
+    return px.Decided(args, reply)
+  })
+}
+
+func (t *simTransport) Ping(ctx context.Context, peer string,
+                            args *PingArgs, reply *PingReply) bool {
+  return t.deliver(ctx, peer, "Ping", func(px *Paxos, dup bool) error {
+    if dup {
+      return px.Ping(args, &PingReply{})
+    }
+    return px.Ping(args, reply)
+  })
+}
+
+// simTransport::deliver():
+// Runs handle, for message msg, on the peer listening on addr after
+// the message's delay,
+// unless ctx is done first. A lost message is given up on after its
+// delay. A duplicate is handled later in the background, with its
+// reply discarded.
+func (t *simTransport) deliver(ctx context.Context, addr string, msg string,
+                               handle func(px *Paxos, dup bool) error) bool {
+  f := t.nw.route(t.addr, addr, msg)
+  if f.px != nil && f.dupDelay > 0 {
+    time.AfterFunc(f.dupDelay, func() {
+      handle(f.px, true)
+    })
+  }
+
+  timer := time.NewTimer(f.delay)
+  defer timer.Stop()
+  select {
+  case <-timer.C:
+  case <-ctx.Done():
+    return false
+  }
+  if f.px == nil {
+    return false
+  }
+  ok := handle(f.px, false) == nil
+  return ok && !f.loseReply
+}
+
+func (t *simTransport) Close() error {
+  t.nw.mu.Lock()
+  defer t.nw.mu.Unlock()
+  delete(t.nw.peers, t.addr)
+  return nil
+}
@@ -10,6 +10,14 @@ import "math/rand"
 import crand "crypto/rand"
 import "encoding/base64"
 import "sync/atomic"
+import "sync"
+import "flag"
+import "context"
+import "sort"
+import "reflect"
+import "bytes"
+import "strings"
+import "logger"
 
 func randstring(n int) string {
 	b := make([]byte, 2*n)
@@ -527,16 +535,16 @@ func TestRPCCount(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 
-	total1 := int32(0)
+	total1 := int64(0)
 	for j := 0; j < npaxos; j++ {
-		total1 += atomic.LoadInt32(&pxa[j].rpcCount)
+		total1 += pxa[j].Stats().RPCCount
 	}
 
 	// per agreement:
 	// 3 prepares
 	// 3 accepts
 	// 3 decides
-	expected1 := int32(ninst1 * npaxos * npaxos)
+	expected1 := int64(ninst1 * npaxos * npaxos)
 	if total1 > expected1 {
 		t.Fatalf("too many RPCs for serial Start()s; %v instances, got %v, expected %v",
 			ninst1, total1, expected1)
@@ -553,9 +561,9 @@ func TestRPCCount(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 
-	total2 := int32(0)
+	total2 := int64(0)
 	for j := 0; j < npaxos; j++ {
-		total2 += atomic.LoadInt32(&pxa[j].rpcCount)
+		total2 += pxa[j].Stats().RPCCount
 	}
 	total2 -= total1
 
@@ -563,7 +571,7 @@ func TestRPCCount(t *testing.T) {
 	// Proposer 1: 3 prep, 3 acc, 3 decides.
 	// Proposer 2: 3 prep, 3 acc, 3 prep, 3 acc, 3 decides.
 	// Proposer 3: 3 prep, 3 acc, 3 prep, 3 acc, 3 prep, 3 acc, 3 decides.
-	expected2 := int32(ninst2 * npaxos * 15)
+	expected2 := int64(ninst2 * npaxos * 15)
 	if total2 > expected2 {
 		t.Fatalf("too many RPCs for concurrent Start()s; %v instances, got %v, expected %v",
 			ninst2, total2, expected2)
@@ -572,6 +580,711 @@ func TestRPCCount(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+func TestStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Stats count messages ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("stats", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	const ninst = 5
+	for seq := 0; seq < ninst; seq++ {
+		pxa[0].Start(seq, "x")
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	st := pxa[0].Stats()
+	if st.Decisions != ninst {
+		t.Fatalf("wrong Decisions; got %v, expected %v", st.Decisions, ninst)
+	}
+	if st.Rounds < ninst || st.Prepares < ninst*npaxos || st.Accepts < ninst*npaxos {
+		t.Fatalf("too few messages counted; %+v", st)
+	}
+	if st.PrepareRejects != 0 || st.AcceptRejects != 0 {
+		t.Fatalf("rejections counted without contention; %+v", st)
+	}
+	if st.DecisionRounds[0] != ninst || st.RoundsToDecide != ninst {
+		t.Fatalf("uncontended decisions took more than a round; %+v", st)
+	}
+	if other := pxa[1].Stats(); other.Rounds != 0 || other.RPCCount == 0 {
+		t.Fatalf("wrong stats on passive peer; %+v", other)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPeerStatus(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: PeerStatus tracks reachability ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("peerstatus", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	for i, ps := range pxa[0].PeerStatus() {
+		if ps.Contacted != (i == 0) || ps.Done != -1 {
+			t.Fatalf("wrong initial PeerStatus %v: %+v", i, ps)
+		}
+	}
+
+	os.Remove(pxh[2])
+	pxa[0].Start(0, "x")
+	waitmajority(t, pxa, 0)
+	time.Sleep(100 * time.Millisecond)
+
+	ps := pxa[0].PeerStatus()
+	if !ps[0].Reachable || !ps[1].Reachable || ps[1].LastContact.IsZero() {
+		t.Fatalf("reachable peer reported down: %+v", ps)
+	}
+	if !ps[2].Contacted || ps[2].Reachable {
+		t.Fatalf("deaf peer reported up: %+v", ps[2])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestProbe(t *testing.T) {
+	fmt.Printf("Test: Probe refreshes PeerStatus of idle peers ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "probe-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+		pxa[i].SetTimeout(50 * time.Millisecond)
+	}
+	pxa[2].Done(4)
+	nw.Disconnect(pxh[1])
+
+	pxa[0].Probe(time.Hour)
+	ps := pxa[0].PeerStatus()
+	if !ps[1].Contacted || ps[1].Reachable {
+		t.Fatalf("disconnected peer reported up: %+v", ps[1])
+	}
+	if !ps[2].Reachable || ps[2].LastContact.IsZero() || ps[2].Done != 4 {
+		t.Fatalf("probed peer: %+v", ps[2])
+	}
+	// a probe is not a Prepare of any instance
+	if st := pxa[0].Stats(); st.Prepares != 0 || st.RPCFailures != 1 {
+		t.Fatalf("probe counted as %+v", st)
+	}
+	if st := pxa[2].Stats(); st.RPCCount != 0 {
+		t.Fatalf("ping counted as %v RPCs", st.RPCCount)
+	}
+	pxa[2].mu.Lock()
+	n := len(pxa[2].acceptorInstances)
+	pxa[2].mu.Unlock()
+	if n != 0 {
+		t.Fatalf("probe created %v acceptor instances", n)
+	}
+
+	// peers heard from recently enough are left alone
+	nw.Reconnect(pxh[1])
+	nw.Disconnect(pxh[2])
+	pxa[0].Probe(time.Hour)
+	ps = pxa[0].PeerStatus()
+	if !ps[1].Reachable || !ps[2].Reachable {
+		t.Fatalf("after a second probe: %+v", ps)
+	}
+	pxa[0].Probe(0)
+	if ps := pxa[0].PeerStatus(); ps[2].Reachable {
+		t.Fatalf("disconnected peer still up after probing it: %+v", ps[2])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// lockedBuffer is a bytes.Buffer that peers may log to concurrently.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.String()
+}
+
+func TestMakeWithLogger(t *testing.T) {
+	fmt.Printf("Test: Peers log through the logger they are made with ...\n")
+
+	var out lockedBuffer
+	pxh := []string{port("logger", 0)}
+	pxa := []*Paxos{MakeWithLogger(pxh, 0, nil, logger.New(&out, logger.Debug))}
+	defer cleanup(pxa)
+
+	if line := out.String(); !strings.Contains(line, " msg=listen\n") ||
+		!strings.Contains(line, " replica=0 ") {
+		t.Fatalf("logged %q", line)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMemTransport(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: In-memory transport ...\n")
+
+	const npaxos = 5
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "mem-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+
+	pxa[0].Start(0, "hello")
+	waitn(t, pxa, 0, npaxos)
+
+	nw.Disconnect(pxh[0])
+	nw.Disconnect(pxh[npaxos-1])
+	pxa[1].Start(1, "goodbye")
+	waitmajority(t, pxa, 1)
+	if ndecided(t, pxa, 1) != npaxos-2 {
+		t.Fatalf("a disconnected peer heard about a decision")
+	}
+
+	pxa[0].Start(1, "xxx")
+	time.Sleep(100 * time.Millisecond)
+	if ndecided(t, pxa, 1) != npaxos-2 {
+		t.Fatalf("a disconnected peer reached a decision")
+	}
+
+	nw.Reconnect(pxh[0])
+	nw.Reconnect(pxh[npaxos-1])
+	pxa[npaxos-1].Start(1, "yyy")
+	waitn(t, pxa, 1, npaxos)
+	if _, v := pxa[0].Status(1); v != "goodbye" {
+		t.Fatalf("wrong value decided after reconnect: %v", v)
+	}
+
+	// a message to a hung peer is dropped, not left waiting, when it
+	// is given up on
+	nw.SetDelay(pxh[1], time.Hour)
+	n := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	reply := PingReply{DoneUpTo: 42}
+	if pxa[0].transport.Ping(ctx, pxh[1], &PingArgs{}, &reply) {
+		t.Fatalf("hung peer replied")
+	}
+	cancel()
+	if reply.DoneUpTo != 42 {
+		t.Fatalf("reply written by a message given up on: %+v", reply)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if m := runtime.NumGoroutine(); m > n {
+		t.Fatalf("%v goroutines before sending to hung peer, %v after", n, m)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPooledTransport(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Persistent connections, unreliable ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("pooled", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, NewPooledRPCTransport(time.Second))
+	}
+
+	// a message given up on before it is sent does not dial
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if pxa[2].transport.Ping(ctx, pxh[1], &PingArgs{}, &PingReply{}) {
+		t.Fatalf("message sent after its context was cancelled")
+	}
+
+	pxa[0].Start(0, "hello")
+	waitn(t, pxa, 0, npaxos)
+	time.Sleep(100 * time.Millisecond)
+
+	if st := pxa[1].Stats(); st.RPCCount != 3 {
+		t.Fatalf("%v RPCs counted, want 3", st.RPCCount)
+	}
+	if st := pxa[0].Stats(); st.RPCCount != 0 {
+		t.Fatalf("messages to itself counted as %v RPCs", st.RPCCount)
+	}
+
+	// pings are answered, but not counted, over the connection that
+	// carried the Prepare, Accept and Decided
+	pt := pxa[0].transport.(*pooledTransport)
+	c := pt.client(context.Background(), pxh[1])
+	pxa[0].Probe(0)
+	if ps := pxa[0].PeerStatus(); !ps[1].Reachable || !ps[2].Reachable {
+		t.Fatalf("pinged peers not reachable: %+v", ps)
+	}
+	if st := pxa[1].Stats(); st.RPCCount != 3 {
+		t.Fatalf("ping counted; %v RPCs", st.RPCCount)
+	}
+	if pt.client(context.Background(), pxh[1]) != c {
+		t.Fatalf("ping redialed")
+	}
+
+	// dropped connections must be redialed
+	for i := 0; i < npaxos; i++ {
+		pxa[i].setunreliable(true)
+	}
+	for seq := 1; seq < 10; seq++ {
+		for i := 0; i < npaxos; i++ {
+			pxa[i].Start(seq, (seq*10)+i)
+		}
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].setunreliable(false)
+	}
+	for seq := 1; seq < 10; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSlowPeer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Slow peer does not stall rounds ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "slow-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+	nw.SetDelay(pxh[2], time.Hour)
+
+	t0 := time.Now()
+	for seq := 0; seq < 5; seq++ {
+		pxa[0].Start(seq, seq)
+		for {
+			if fate, _ := pxa[0].Status(seq); fate == Decided {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if d := time.Since(t0); d > DefaultTimeout {
+		t.Fatalf("5 agreements took %v with one hung peer", d)
+	}
+	if ps := pxa[0].PeerStatus(); ps[2].Contacted {
+		t.Fatalf("abandoned message counted against slow peer: %+v", ps[2])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRPCTimeout(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Rounds give up on hung peers ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "timeout-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+		pxa[i].SetTimeout(50 * time.Millisecond)
+	}
+	nw.SetDelay(pxh[1], time.Hour)
+	nw.SetDelay(pxh[2], time.Hour)
+
+	pxa[0].Start(0, "x")
+	time.Sleep(500 * time.Millisecond)
+
+	st := pxa[0].Stats()
+	if st.Rounds < 2 || st.RPCFailures < 2 {
+		t.Fatalf("round did not time out: %+v", st)
+	}
+	if ndecided(t, pxa, 0) != 0 {
+		t.Fatalf("decided without a majority")
+	}
+	ps := pxa[0].PeerStatus()
+	if !ps[1].Contacted || ps[1].Reachable {
+		t.Fatalf("hung peer reported up: %+v", ps[1])
+	}
+
+	// once the peers recover, the pending proposal goes through
+	nw.SetDelay(pxh[1], 0)
+	nw.SetDelay(pxh[2], 0)
+	waitn(t, pxa, 0, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestEarlyRejection(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Rejected rounds end without waiting for hung peer ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "earlyrej-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+	nw.SetDelay(pxh[2], time.Hour)
+
+	// peers 0 and 1 promise a higher proposal, so the first round
+	// of peer 0 is rejected by a majority
+	args := &PrepareArgs{0, ProposalNumber{5, 1}}
+	pxa[0].Prepare(args, &PrepareReply{})
+	pxa[1].Prepare(args, &PrepareReply{})
+
+	t0 := time.Now()
+	pxa[0].Start(0, "x")
+	for {
+		if fate, _ := pxa[0].Status(0); fate == Decided {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if d := time.Since(t0); d > DefaultTimeout/2 {
+		t.Fatalf("decision took %v; rejected round waited for hung peer", d)
+	}
+	if st := pxa[0].Stats(); st.Rounds != 2 || st.PrepareRejects != 2 ||
+		st.DecisionRounds[1] != 1 || st.RoundsToDecide != 2 {
+		t.Fatalf("expected one rejected round; %+v", st)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestStragglers(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Stragglers still report Done values ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "straggler-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+	nw.SetDelay(pxh[2], 50*time.Millisecond)
+	pxa[2].Done(7)
+
+	pxa[0].Start(0, "x")
+	waitn(t, pxa, 0, 2)
+	time.Sleep(200 * time.Millisecond)
+
+	if ps := pxa[0].PeerStatus(); ps[2].Done != 7 || !ps[2].Reachable {
+		t.Fatalf("late reply from slow peer was dropped: %+v", ps[2])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLatePrepare(t *testing.T) {
+	fmt.Printf("Test: Prepare arriving after its accept is promised again ...\n")
+
+	pxh := []string{"lateprep-0"}
+	px := Make(pxh, 0, NewMemNetwork().Transport())
+	defer cleanup([]*Paxos{px})
+
+	// the round completed without this peer's promise, whose prepare
+	// is delivered only after the accept
+	n := ProposalNumber{1, 2}
+	acc := AcceptReply{}
+	px.Accept(&AcceptArgs{0, n, "x"}, &acc)
+	reply := PrepareReply{}
+	px.Prepare(&PrepareArgs{0, n}, &reply)
+	if acc.Result != OK || reply.Result != OK || reply.AccMax != n ||
+		reply.Value != "x" {
+		t.Fatalf("late prepare answered %+v after accept %+v", reply, acc)
+	}
+
+	// a lower proposal is still rejected
+	reply = PrepareReply{}
+	px.Prepare(&PrepareArgs{0, ProposalNumber{1, 1}}, &reply)
+	if reply.Result != Rejected || reply.PNHint != n {
+		t.Fatalf("lower prepare answered %+v", reply)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+var simSeed = flag.Int64("simseed", 0, "replay only this simulated schedule")
+
+//
+// runs one random schedule of proposals and partitions on a
+// SimNetwork, then heals the network and checks that every instance
+// was decided on one of the values proposed for it, the same on
+// every peer.
+//
+func runSimSchedule(seed int64) error {
+	rng := rand.New(rand.NewSource(seed))
+	npaxos := 3 + 2*rng.Intn(2)
+	cfg := SimConfig{}
+	cfg.MaxDelay = time.Duration(rng.Intn(500)) * time.Microsecond
+	cfg.Loss = rng.Float64() * 0.3
+	cfg.Dup = rng.Float64() * 0.3
+
+	nw := NewSimNetwork(seed, cfg)
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "sim-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+
+	ninst := 1 + rng.Intn(3)
+	proposed := make([]map[int]bool, ninst)
+	for seq := 0; seq < ninst; seq++ {
+		proposed[seq] = make(map[int]bool)
+	}
+	start := func(i int, seq int) {
+		v := rng.Int()
+		proposed[seq][v] = true
+		pxa[i].Start(seq, v)
+	}
+
+	for step := 0; step < 8; step++ {
+		switch rng.Intn(4) {
+		case 0, 1:
+			start(rng.Intn(npaxos), rng.Intn(ninst))
+		case 2:
+			perm := rng.Perm(npaxos)
+			cut := rng.Intn(npaxos)
+			var g1, g2 []string
+			for j, i := range perm {
+				if j < cut {
+					g1 = append(g1, pxh[i])
+				} else {
+					g2 = append(g2, pxh[i])
+				}
+			}
+			nw.Partition(g1, g2)
+		case 3:
+			nw.Heal()
+		}
+		time.Sleep(time.Duration(rng.Intn(500)) * time.Microsecond)
+	}
+
+	// every peer proposes, so that every peer learns the outcome even
+	// if the Decided messages to it were lost
+	nw.Heal()
+	for seq := 0; seq < ninst; seq++ {
+		for i := 0; i < npaxos; i++ {
+			start(i, seq)
+		}
+	}
+
+	for seq := 0; seq < ninst; seq++ {
+		t0 := time.Now()
+		for {
+			ndone := 0
+			var v0 interface{}
+			for i := 0; i < npaxos; i++ {
+				st, v := pxa[i].Status(seq)
+				if st != Decided {
+					continue
+				}
+				if !proposed[seq][v.(int)] {
+					return fmt.Errorf("seed %v: seq %v decided on %v, which was never proposed", seed, seq, v)
+				}
+				if ndone > 0 && v != v0 {
+					return fmt.Errorf("seed %v: seq %v decided on both %v and %v", seed, seq, v0, v)
+				}
+				ndone++
+				v0 = v
+			}
+			if ndone == npaxos {
+				break
+			}
+			if time.Since(t0) > 20*time.Second {
+				return fmt.Errorf("seed %v: seq %v decided by only %v of %v peers", seed, seq, ndone, npaxos)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// simTrace sends the same messages over a fresh SimNetwork seeded with
+// seed, every link from a goroutine of its own, and returns the fates
+// the messages met, sorted.
+func simTrace(seed int64) []string {
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+	nw := NewSimNetwork(seed, SimConfig{MaxDelay: 100 * time.Microsecond,
+		Loss: 0.3, Dup: 0.3})
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "simtrace-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+	nw.Trace()
+
+	var wg sync.WaitGroup
+	for i := 0; i < npaxos; i++ {
+		for j := 0; j < npaxos; j++ {
+			wg.Add(1)
+			go func(i int, j int) {
+				defer wg.Done()
+				for seq := 0; seq < 20; seq++ {
+					args := &PrepareArgs{seq, ProposalNumber{1, i}}
+					pxa[i].transport.Prepare(context.Background(), pxh[j],
+						args, &PrepareReply{})
+					pxa[i].transport.Decided(context.Background(), pxh[j],
+						&DecidedArgs{seq, i}, &DecidedReply{})
+				}
+			}(i, j)
+		}
+	}
+	wg.Wait()
+	trace := nw.Trace()
+	sort.Strings(trace)
+	return trace
+}
+
+func TestSimulatedReplay(t *testing.T) {
+	fmt.Printf("Test: A simulated network replays from its seed ...\n")
+
+	trace := simTrace(7)
+	if len(trace) != 3*3*2*20 {
+		t.Fatalf("%v messages traced", len(trace))
+	}
+	if again := simTrace(7); !reflect.DeepEqual(again, trace) {
+		for i := range trace {
+			if again[i] != trace[i] {
+				t.Fatalf("seed 7 replayed %q as %q", trace[i], again[i])
+			}
+		}
+	}
+	if other := simTrace(8); reflect.DeepEqual(other, trace) {
+		t.Fatalf("seeds 7 and 8 gave the same trace")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSimulatedSchedules(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	if *simSeed != 0 {
+		fmt.Printf("Test: Simulated schedule %v ...\n", *simSeed)
+		if err := runSimSchedule(*simSeed); err != nil {
+			t.Fatalf("%v", err)
+		}
+		fmt.Printf("  ... Passed\n")
+		return
+	}
+
+	nsched := 2000
+	if testing.Short() {
+		nsched = 200
+	}
+	fmt.Printf("Test: Agreement and validity over %v simulated schedules ...\n", nsched)
+
+	// schedules are independent, so run several at once
+	const nworkers = 16
+	seeds := make(chan int64)
+	errs := make(chan error, nsched)
+	var wg sync.WaitGroup
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seed := range seeds {
+				if err := runSimSchedule(seed); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for seed := 1; seed <= nsched; seed++ {
+		seeds <- int64(seed)
+	}
+	close(seeds)
+	wg.Wait()
+	close(errs)
+
+	if len(errs) > 0 {
+		for err := range errs {
+			t.Errorf("%v (replay with -simseed)", err)
+		}
+		return
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements (without failures)
 //
@@ -709,6 +1422,66 @@ func TestManyUnreliable(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+//
+// every peer proposes its own value for the same instances at the same
+// time, over an unreliable network. without backoff the proposers can
+// keep preempting each other's prepares indefinitely.
+//
+func TestDuelingProposers(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Dueling proposers, unreliable RPC ...\n")
+
+	const npaxos = 5
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("duel", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+		pxa[i].setunreliable(true)
+	}
+
+	const ninst = 20
+	t0 := time.Now()
+	for seq := 0; seq < ninst; seq++ {
+		// two instances at a time, to limit the number of
+		// file descriptors.
+		for seq >= 2 && ndecided(t, pxa, seq-2) < npaxos {
+			time.Sleep(10 * time.Millisecond)
+			if time.Since(t0) > 60*time.Second {
+				t.Fatalf("instance %v still undecided; livelock?", seq-2)
+			}
+		}
+		for i := 0; i < npaxos; i++ {
+			pxa[i].Start(seq, (seq*10)+i)
+		}
+	}
+	for seq := 0; seq < ninst; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	// backing off keeps the duels short: every decision takes fewer
+	// than RoundBuckets rounds of its proposer
+	backoffs := int64(0)
+	for i := 0; i < npaxos; i++ {
+		st := pxa[i].Stats()
+		backoffs += st.Backoffs
+		if n := st.DecisionRounds[RoundBuckets-1]; n > 0 {
+			t.Fatalf("peer %v took %v or more rounds for %v decisions: %v",
+				i, RoundBuckets, n, st.DecisionRounds)
+		}
+	}
+	if backoffs == 0 {
+		t.Fatalf("no proposer ever backed off")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func pp(tag string, src int, dst int) string {
 	s := "/var/tmp/824-"
 	s += strconv.Itoa(os.Getuid()) + "/"
@@ -955,3 +1728,68 @@ func TestLots(t *testing.T) {
 
 	fmt.Printf("  ... Passed\n")
 }
+
+func benchmarkAgreements(b *testing.B, tag string, mk func() Transport) {
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port(tag, i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, mk())
+	}
+
+	b.ResetTimer()
+	for seq := 0; seq < b.N; seq++ {
+		pxa[0].Start(seq, seq)
+		for {
+			if fate, _ := pxa[0].Status(seq); fate == Decided {
+				break
+			}
+			time.Sleep(20 * time.Microsecond)
+		}
+	}
+}
+
+func BenchmarkDialPerCall(b *testing.B) {
+	benchmarkAgreements(b, "benchdial", func() Transport {
+		return NewRPCTransport(nil)
+	})
+}
+
+func BenchmarkPooled(b *testing.B) {
+	benchmarkAgreements(b, "benchpool", func() Transport {
+		return NewPooledRPCTransport(time.Second)
+	})
+}
+
+func BenchmarkOneDelayedPeer(b *testing.B) {
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	nw := NewMemNetwork()
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = "benchdelay-" + strconv.Itoa(i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nw.Transport())
+	}
+	nw.SetDelay(pxh[1], time.Millisecond)
+	nw.SetDelay(pxh[2], 20*time.Millisecond)
+
+	b.ResetTimer()
+	for seq := 0; seq < b.N; seq++ {
+		pxa[0].Start(seq, seq)
+		for {
+			if fate, _ := pxa[0].Status(seq); fate == Decided {
+				break
+			}
+			time.Sleep(20 * time.Microsecond)
+		}
+	}
+}
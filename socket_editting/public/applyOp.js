@@ -8,7 +8,8 @@ function applyOp (incoming_op) {
       for (var i = 0; i < local_op.length; i++) {
         local_op[i].Version++;
       };
-      if (sent == true) {sent = false};
+      if (resumed > 0) {resumed--};
+      if (sent == true && resumed == 0) {sent = false};
     }else{
       //update local change
       for (var i = 0; i < local_op.length; i++) {
@@ -16,19 +17,19 @@ function applyOp (incoming_op) {
 
         if (incoming_op.Type == "Insert" && local_op[i].Type == "Insert") {
           if (incoming_op.Position <= local_op[i].Position) {
-            local_op[i].Position = local_op[i].Position + 1;
+            local_op[i].Position = local_op[i].Position + opLength(incoming_op);
           };
         }else if (incoming_op.Type == "Delete" && local_op[i].Type == "Insert") {
           if (incoming_op.Position < local_op[i].Position) {
-            local_op[i].Position = local_op[i].Position - 1;
+            local_op[i].Position = local_op[i].Position - opLength(incoming_op);
           };
         }else if (incoming_op.Type == "Insert" && local_op[i].Type == "Delete") {
           if (incoming_op.Position <= local_op[i].Position) {
-            local_op[i].Position = local_op[i].Position + 1;
+            local_op[i].Position = local_op[i].Position + opLength(incoming_op);
           };
         }else if (incoming_op.Type == "Delete" && local_op[i].Type == "Delete") {
           if (incoming_op.Position < local_op[i].Position) {
-            local_op[i].Position = local_op[i].Position - 1;
+            local_op[i].Position = local_op[i].Position - opLength(incoming_op);
           }else if (incoming_op.Position = local_op[i].Position) {
             if (sent == true) { //will be ignored on server, will not return
               local_op.splice(0,1);
@@ -45,11 +46,11 @@ function applyOp (incoming_op) {
       //update cursor position
       if (incoming_op.Type == "Insert") {
         if (incoming_op.Position <= cursor_pos) {
-          cursor_pos++;
+          cursor_pos += opLength(incoming_op);
         };
       }else if (incoming_op.Type == "Delete") {
         if (incoming_op.Position < cursor_pos) {
-          cursor_pos--;
+          cursor_pos -= opLength(incoming_op);
         };
       };
 
@@ -68,11 +69,39 @@ function applyOp (incoming_op) {
     version_num++;
 }
 
+// Positions and lengths count UTF-16 code units, like string indices.
+// A delete removes one code point, as on the server, which is two
+// units for most emoji; its Value is that code point.
+function opLength (op) {
+  if (op.Type == "Delete") {return codePointLength(op.Value, 0)};
+  return op.Value.length;
+}
+
+// the units of the code point at index of s, 1 past its end
+function codePointLength (s, index) {
+  if (index + 1 < s.length && /[\uD800-\uDBFF]/.test(s[index]) &&
+      /[\uDC00-\uDFFF]/.test(s[index+1])) {
+    return 2;
+  };
+  return 1;
+}
+
+// s split into code points
+function codePoints (s) {
+  var ret = [];
+  for (var i = 0; i < s.length; i += codePointLength(s, i)) {
+    ret.push(s.substr(i, codePointLength(s, i)));
+  };
+  return ret;
+}
+
 String.prototype.opAt = function(ind, index, c) {
   if (ind == "Insert") {
     return this.substr(0, index) + c + this.substr(index);
   }else if (ind == "Delete") {
-    return this.substr(0, index) + this.substr(index+1);
+    return this.substr(0, index) + this.substr(index + codePointLength(this, index));
+  }else{
+    return this.toString();
   };
 };
 
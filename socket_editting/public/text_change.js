@@ -15,14 +15,14 @@ function text_change () {
 			for (var i = 0; i < oldVal.length; i++) {
 				if (oldVal[i] !== newVal[i]) {
 					position = i;
-					value = newVal[position];
+					value = newVal.substr(position, newVal.length - oldVal.length);
 					found = true;
 					break;
 				};
 			};
 			if (found == false) {
 				position = oldVal.length;
-				value = newVal[position];
+				value = newVal.substr(position);
 			};
 
 		}else if (oldVal.length > newVal.length) {
@@ -31,19 +31,27 @@ function text_change () {
 			for (var i = 0; i < newVal.length; i++) {
 				if (oldVal[i] !== newVal[i]) {
 					position = i;
-					value = oldVal[position];
+					value = oldVal.substr(position, oldVal.length - newVal.length);
 					found = true;
 					break;
 				};
 			};
 			if (found == false) {
-				position = oldVal.length-1;
-				value = oldVal[position];
+				position = newVal.length;
+				value = oldVal.substr(position);
 			};
 		}
 
 		//this.oldVal = newVal;
-		if (type !== undefined && position !== undefined && value !== undefined) {
+		if (type == "Delete" && position !== undefined && value !== undefined) {
+			//the server deletes one code point per op, so a selection
+			//is deleted through one op per code point
+			var chars = codePoints(value);
+			for (var i = 0; i < chars.length; i++) {
+				var op = {ID: id, Version: version_num, Type: type, Position: position, Value: chars[i]};
+				local_op.push(op);
+			};
+		}else if (type !== undefined && position !== undefined && value !== undefined) {
 			var op = {ID: id, Version: version_num, Type: type, Position: position, Value: value};
 			local_op.push(op);
 		};